@@ -1,3 +1,3 @@
 module 6.824-lab
 
-go 1.13
+go 1.18
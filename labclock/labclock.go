@@ -0,0 +1,316 @@
+package labclock
+
+//
+// clocks, so that labrpc and Raft can run in simulated time.
+//
+// labclock.Real -- the time package, for everyday use.
+//
+// sim := labclock.NewSim() -- simulated time, which only moves when
+//   told to. every timer, Sleep() and After() waits for simulated
+//   time to reach it.
+// sim.Advance(d) -- move time on by d, firing the timers due on the
+//   way, in order.
+// sim.AutoAdvance(quiet) -- from now on, whenever every other
+//   goroutine is blocked, jump straight to the next timer.
+//   sim.Stop() ends it. runtimes that can't say who is blocked
+//   instead wait until nobody has touched a timer for quiet (in
+//   real time).
+//
+// with AutoAdvance(), a test that spends most of its time waiting
+// for timeouts runs in a fraction of the time; but code that waits
+// on real time, or on older runtimes computes for longer than quiet,
+// sees simulated time race ahead of it, as on a very slow machine.
+//
+
+import (
+	"container/heap"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	// runs f in its own goroutine once d has passed.
+	AfterFunc(d time.Duration, f func()) Timer
+	NewTimer(d time.Duration) Timer
+}
+
+// as time.Timer, with the channel behind a method.
+type Timer interface {
+	C() <-chan time.Time // nil for AfterFunc()'s timers
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+//
+// real time
+//
+
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (rt realTimer) C() <-chan time.Time        { return rt.t.C }
+func (rt realTimer) Stop() bool                 { return rt.t.Stop() }
+func (rt realTimer) Reset(d time.Duration) bool { return rt.t.Reset(d) }
+
+//
+// simulated time
+//
+
+type Sim struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  timerHeap
+	seq     uint64    // orders timers due at the same instant
+	touched time.Time // real time of the last timer change, see AutoAdvance()
+	stop    chan struct{}
+}
+
+// starts at the same instant every time, for reproducible runs.
+func NewSim() *Sim {
+	return &Sim{now: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+type simTimer struct {
+	s     *Sim
+	when  time.Time
+	seq   uint64
+	index int            // in s.timers, -1 if not pending
+	ch    chan time.Time // for NewTimer() and friends
+	f     func()         // for AfterFunc()
+}
+
+func (s *Sim) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+func (s *Sim) Since(t time.Time) time.Duration {
+	return s.Now().Sub(t)
+}
+
+func (s *Sim) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	<-s.After(d)
+}
+
+func (s *Sim) After(d time.Duration) <-chan time.Time {
+	return s.NewTimer(d).C()
+}
+
+func (s *Sim) AfterFunc(d time.Duration, f func()) Timer {
+	t := &simTimer{s: s, index: -1, f: f}
+	t.Reset(d)
+	return t
+}
+
+func (s *Sim) NewTimer(d time.Duration) Timer {
+	t := &simTimer{s: s, index: -1, ch: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+func (t *simTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *simTimer) Stop() bool {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	t.s.touched = time.Now()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.s.timers, t.index)
+	return true
+}
+
+func (t *simTimer) Reset(d time.Duration) bool {
+	s := t.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.touched = time.Now()
+	pending := t.index >= 0
+	if pending {
+		heap.Remove(&s.timers, t.index)
+	}
+	if d < 0 {
+		d = 0
+	}
+	s.seq++
+	t.when = s.now.Add(d)
+	t.seq = s.seq
+	heap.Push(&s.timers, t)
+	return pending
+}
+
+func (s *Sim) Advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advanceTo(s.now.Add(d))
+}
+
+// should be called when holding the lock. fires every timer due by
+// then, each at its own instant.
+func (s *Sim) advanceTo(then time.Time) {
+	for len(s.timers) > 0 && !s.timers[0].when.After(then) {
+		t := heap.Pop(&s.timers).(*simTimer)
+		s.now = t.when
+		s.touched = time.Now()
+		if t.f != nil {
+			go t.f()
+		} else {
+			select {
+			case t.ch <- s.now:
+			default:
+			}
+		}
+	}
+	if then.After(s.now) {
+		s.now = then
+	}
+}
+
+func (s *Sim) AutoAdvance(quiet time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	go s.autoAdvancer(quiet, s.stop)
+}
+
+// stop AutoAdvance().
+func (s *Sim) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// autoAdvancer jumps to the next timer whenever everyone else is
+// blocked, exits when stop is closed.
+func (s *Sim) autoAdvancer(quiet time.Duration, stop chan struct{}) {
+	samples := schedSamples()
+	spins := 0
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		blocked, known := othersBlocked(samples)
+		s.mu.Lock()
+		idle := time.Since(s.touched)
+		if !known {
+			blocked = idle >= quiet
+		}
+		pending := len(s.timers) > 0
+		if blocked && pending {
+			// everyone is waiting for time to pass
+			s.advanceTo(s.timers[0].when)
+		}
+		s.mu.Unlock()
+
+		switch {
+		case known && (pending || !blocked) && spins < 100:
+			// let whoever is runnable, or was just woken, have a turn
+			spins++
+			runtime.Gosched()
+		case known || idle >= quiet:
+			spins = 0
+			time.Sleep(quiet)
+		default:
+			time.Sleep(quiet - idle)
+		}
+		if blocked && pending {
+			spins = 0
+		}
+	}
+}
+
+// the scheduler's counts of goroutines that aren't blocked.
+func schedSamples() []metrics.Sample {
+	return []metrics.Sample{
+		{Name: "/sched/goroutines/running:goroutines"},
+		{Name: "/sched/goroutines/runnable:goroutines"},
+		{Name: "/sched/goroutines/not-in-go:goroutines"}, // in syscalls
+	}
+}
+
+// whether every goroutine but the caller is blocked. known is false
+// if the runtime doesn't say, as older ones don't.
+func othersBlocked(samples []metrics.Sample) (blocked bool, known bool) {
+	metrics.Read(samples)
+	for _, sample := range samples {
+		if sample.Value.Kind() != metrics.KindUint64 {
+			return false, false
+		}
+	}
+	running := samples[0].Value.Uint64()
+	runnable := samples[1].Value.Uint64()
+	syscalls := samples[2].Value.Uint64()
+	return running <= 1 && runnable == 0 && syscalls == 0, true
+}
+
+// earliest first, then in the order they were set.
+type timerHeap []*simTimer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*simTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
@@ -0,0 +1,145 @@
+package labclock
+
+import "testing"
+import "time"
+import "sync"
+
+func TestAdvance(t *testing.T) {
+	s := NewSim()
+	start := s.Now()
+
+	var mu sync.Mutex
+	fired := []int{}
+	var wg sync.WaitGroup
+	for _, i := range []int{3, 1, 2} {
+		i := i
+		wg.Add(1)
+		s.AfterFunc(time.Duration(i)*time.Second, func() {
+			defer wg.Done()
+			mu.Lock()
+			fired = append(fired, i)
+			mu.Unlock()
+		})
+	}
+	timer := s.NewTimer(2 * time.Second)
+
+	s.Advance(1500 * time.Millisecond)
+	if d := s.Since(start); d != 1500*time.Millisecond {
+		t.Fatalf("Since() is %v after Advance(1.5s)", d)
+	}
+	select {
+	case <-timer.C():
+		t.Fatalf("2s timer fired after 1.5s")
+	default:
+	}
+
+	s.Advance(time.Second)
+	select {
+	case when := <-timer.C():
+		if d := when.Sub(start); d != 2*time.Second {
+			t.Fatalf("2s timer fired at %v", d)
+		}
+	default:
+		t.Fatalf("2s timer didn't fire after 2.5s")
+	}
+
+	s.Advance(time.Second)
+	wg.Wait()
+	if len(fired) != 3 {
+		t.Fatalf("%v AfterFunc()s ran, expected 3", len(fired))
+	}
+	for _, i := range fired {
+		if i < 1 || i > 3 {
+			t.Fatalf("unexpected AfterFunc() %v", i)
+		}
+	}
+}
+
+func TestStopReset(t *testing.T) {
+	s := NewSim()
+
+	timer := s.NewTimer(time.Second)
+	if !timer.Stop() {
+		t.Fatalf("Stop() of a pending timer returned false")
+	}
+	if timer.Stop() {
+		t.Fatalf("Stop() of a stopped timer returned true")
+	}
+	s.Advance(2 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatalf("stopped timer fired")
+	default:
+	}
+
+	if timer.Reset(time.Second) {
+		t.Fatalf("Reset() of a stopped timer returned true")
+	}
+	if !timer.Reset(3 * time.Second) {
+		t.Fatalf("Reset() of a pending timer returned false")
+	}
+	s.Advance(2 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatalf("timer fired at its first Reset()")
+	default:
+	}
+	s.Advance(time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Fatalf("timer didn't fire at its second Reset()")
+	}
+
+	ran := false
+	f := s.AfterFunc(time.Second, func() { ran = true })
+	f.Stop()
+	s.Advance(time.Hour)
+	time.Sleep(10 * time.Millisecond)
+	if ran {
+		t.Fatalf("stopped AfterFunc() ran")
+	}
+}
+
+func TestAutoAdvance(t *testing.T) {
+	s := NewSim()
+	s.AutoAdvance(time.Millisecond)
+	defer s.Stop()
+
+	realStart := time.Now()
+	start := s.Now()
+
+	// goroutines waiting on each other and on the clock.
+	var wg sync.WaitGroup
+	ch := make(chan int)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			s.Sleep(time.Minute)
+			ch <- i
+		}
+		close(ch)
+	}()
+	go func() {
+		defer wg.Done()
+		for range ch {
+			<-s.After(time.Minute)
+		}
+	}()
+	wg.Wait()
+
+	if d := s.Since(start); d < 11*time.Minute {
+		t.Fatalf("only %v passed, expected at least 11m", d)
+	}
+	if d := time.Since(realStart); d > 5*time.Second {
+		t.Fatalf("11 simulated minutes took %v", d)
+	}
+
+	// Real runs in real time.
+	realStart = Real.Now()
+	Real.Sleep(10 * time.Millisecond)
+	if d := Real.Since(realStart); d < 10*time.Millisecond {
+		t.Fatalf("Real.Sleep(10ms) took %v", d)
+	}
+}
@@ -0,0 +1,67 @@
+package labrpc
+
+//
+// asynchronous calls, much like net/rpc's.
+//
+// call := end.Go("Raft.AppendEntries", &args, &reply)
+//   starts the call and returns at once. call.Done receives call
+//   when it has finished; call.Error is then nil, or why there was
+//   no reply, as CallErr() would have returned.
+// end.GoContext(ctx, ...) -- the same, but cancelled with ctx.
+//
+// calls := Gather(ctx, ends, "Raft.RequestVote", &args, newReply, n)
+//   sends the same request to every end, and returns the calls that
+//   got a reply as soon as n of them did. fewer than n are returned
+//   if the rest failed, or ctx is done; the calls still outstanding
+//   are cancelled either way.
+//
+
+import "context"
+
+type Call struct {
+	ServiceMethod string
+	Args          interface{}
+	Reply         interface{}
+	Error         error      // nil, or why there was no reply
+	Done          chan *Call // receives the Call once it has finished
+}
+
+func (e *ClientEnd) Go(svcMeth string, args interface{}, reply interface{}) *Call {
+	return e.GoContext(context.Background(), svcMeth, args, reply)
+}
+
+func (e *ClientEnd) GoContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) *Call {
+	return e.goCall(ctx, svcMeth, args, reply, make(chan *Call, 1))
+}
+
+// done must have room for the call, it's never waited on.
+func (e *ClientEnd) goCall(ctx context.Context, svcMeth string, args interface{}, reply interface{}, done chan *Call) *Call {
+	call := &Call{ServiceMethod: svcMeth, Args: args, Reply: reply, Done: done}
+	go func() {
+		call.Error = e.CallContext(ctx, svcMeth, args, reply)
+		call.Done <- call
+	}()
+	return call
+}
+
+// newReply returns a fresh reply for each end, e.g.
+//   func() interface{} { return &RequestVoteReply{} }
+func Gather(ctx context.Context, ends []*ClientEnd, svcMeth string, args interface{}, newReply func() interface{}, n int) []*Call {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// shared by every call, so stragglers never block
+	done := make(chan *Call, len(ends))
+	for _, end := range ends {
+		end.goCall(ctx, svcMeth, args, newReply(), done)
+	}
+
+	var replied []*Call
+	for left := len(ends); left > 0 && len(replied) < n; left-- {
+		call := <-done
+		if call.Error == nil {
+			replied = append(replied, call)
+		}
+	}
+	return replied
+}
@@ -0,0 +1,100 @@
+package labrpc
+
+//
+// why a call failed. CallErr() and CallContext() return one of
+// these, possibly wrapped with details, so test with errors.Is().
+// those where no reply came back also match ErrNoReply; the server
+// did answer ErrUnknownMethod and ErrDecode, so they don't.
+// ErrRequestDropped and ErrReplyDropped both match ErrDropped, which
+// over TCP is all a timed-out call can tell.
+//
+
+import (
+	"errors"
+	"fmt"
+)
+
+type callError struct {
+	msg     string
+	noReply bool  // matches ErrNoReply
+	kind    error // also matches this, if not nil
+}
+
+func (e *callError) Error() string {
+	return e.msg
+}
+
+func (e *callError) Is(target error) bool {
+	return (e.noReply && target == ErrNoReply) || (e.kind != nil && target == e.kind)
+}
+
+var (
+	// the request or the reply was lost, and the handler may or may
+	// not have run: over TCP, the reply did not come within
+	// TCPOptions.CallTimeout.
+	ErrDropped error = &callError{msg: "labrpc: request or reply dropped", noReply: true}
+	// the network lost the request; the handler did not run.
+	ErrRequestDropped error = &callError{msg: "labrpc: request dropped", noReply: true, kind: ErrDropped}
+	// the network lost the reply; the handler did run.
+	ErrReplyDropped error = &callError{msg: "labrpc: reply dropped", noReply: true, kind: ErrDropped}
+	// the end is disabled or not connected, or over TCP, the server
+	// could not be dialed.
+	ErrUnreachable error = &callError{msg: "labrpc: server unreachable", noReply: true}
+	// the server was deleted, or over TCP, the connection broke,
+	// before it replied.
+	ErrServerDead error = &callError{msg: "labrpc: server dead", noReply: true}
+	// the Network was cleaned up, or the TCP end closed.
+	ErrNetworkClosed error = &callError{msg: "labrpc: network closed", noReply: true}
+	// the server has no such service or method.
+	ErrUnknownMethod error = &callError{msg: "labrpc: unknown method"}
+	// args or reply did not decode into the handler's or caller's type.
+	ErrDecode error = &callError{msg: "labrpc: decode failed"}
+)
+
+// in the order they go over TCP, see tcpReply. the more specific
+// dropped errors come first, encodeError() takes the first match.
+var callErrors = []error{
+	ErrRequestDropped,
+	ErrReplyDropped,
+	ErrDropped,
+	ErrUnreachable,
+	ErrServerDead,
+	ErrNetworkClosed,
+	ErrUnknownMethod,
+	ErrDecode,
+}
+
+// an error from the far end of a TCP connection.
+type remoteError struct {
+	err error // one of callErrors
+	msg string
+}
+
+func (e *remoteError) Error() string {
+	return e.msg
+}
+
+func (e *remoteError) Unwrap() error {
+	return e.err
+}
+
+// err as it goes over TCP: its index in callErrors, plus one so that
+// zero is no error, and its text.
+func encodeError(err error) (int, string) {
+	if err == nil {
+		return 0, ""
+	}
+	for i, e := range callErrors {
+		if errors.Is(err, e) {
+			return i + 1, err.Error()
+		}
+	}
+	return 0, err.Error()
+}
+
+func decodeError(kind int, msg string) error {
+	if kind < 1 || kind > len(callErrors) {
+		return fmt.Errorf("%w: %v", ErrServerDead, msg)
+	}
+	return &remoteError{callErrors[kind-1], msg}
+}
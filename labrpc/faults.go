@@ -0,0 +1,174 @@
+package labrpc
+
+//
+// fault profiles: how unreliable the network is, per link and per
+// method, rather than Reliable()'s one setting for everything.
+//
+// net.SetFaultProfile(endname, svcMeth, &FaultProfile{...})
+//   calls on endname to svcMeth follow the profile. a nil endname
+//   means any end, an empty svcMeth any method; nil clears it.
+//   a call follows the most specific profile set:
+//     endname and svcMeth, endname alone, svcMeth alone, neither,
+//     and otherwise Reliable() and LongReordering() as always.
+//   takes effect for calls sent from then on.
+//
+// latencies come from Constant(), Uniform(), Normal() or LongTail(),
+// or any other Latency.
+//
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+type FaultProfile struct {
+	Latency      Latency // before a request is delivered, nil for none
+	DropRequests float64 // chance a request is lost
+	DropReplies  float64 // chance a reply is lost, after the handler ran
+	Duplicate    float64 // chance a request is delivered, and run, twice
+	Reorder      float64 // chance a reply is held back by ReorderDelay
+	ReorderDelay Latency // nil for 200ms to 2.2s, as LongReordering()
+}
+
+// draws a delay, using r for randomness.
+type Latency interface {
+	Sample(r *rand.Rand) time.Duration
+}
+
+type constant time.Duration
+
+func (c constant) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(c)
+}
+
+// always d.
+func Constant(d time.Duration) Latency {
+	return constant(d)
+}
+
+type uniform struct {
+	lo, hi time.Duration
+}
+
+func (u uniform) Sample(r *rand.Rand) time.Duration {
+	if u.hi <= u.lo {
+		return u.lo
+	}
+	return u.lo + time.Duration(r.Int63n(int64(u.hi-u.lo)))
+}
+
+// evenly spread over [lo, hi).
+func Uniform(lo time.Duration, hi time.Duration) Latency {
+	return uniform{lo, hi}
+}
+
+type normal struct {
+	mean, stddev time.Duration
+}
+
+func (n normal) Sample(r *rand.Rand) time.Duration {
+	d := n.mean + time.Duration(r.NormFloat64()*float64(n.stddev))
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// normally distributed, cut off at zero.
+func Normal(mean time.Duration, stddev time.Duration) Latency {
+	return normal{mean, stddev}
+}
+
+type longTail struct {
+	min   time.Duration
+	alpha float64
+}
+
+func (l longTail) Sample(r *rand.Rand) time.Duration {
+	// Pareto: min / U^(1/alpha), U uniform in (0, 1]
+	u := 1 - r.Float64()
+	return time.Duration(float64(l.min) / math.Pow(u, 1/l.alpha))
+}
+
+// Pareto distributed: at least min, usually close to it, now and
+// then much longer. the smaller alpha, the heavier the tail; 1 to
+// 3 is typical.
+func LongTail(min time.Duration, alpha float64) Latency {
+	return longTail{min, alpha}
+}
+
+// LongReordering()'s delay, 200ms plus up to a random 0~2s.
+type reorderDelay struct{}
+
+func (reorderDelay) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(200+r.Intn(1+r.Intn(2000))) * time.Millisecond
+}
+
+type profileKey struct {
+	endname interface{}
+	svcMeth string
+}
+
+func (rn *Network) SetFaultProfile(endname interface{}, svcMeth string, profile *FaultProfile) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	key := profileKey{endname, svcMeth}
+	if profile == nil {
+		delete(rn.profiles, key)
+	} else {
+		p := *profile
+		rn.profiles[key] = &p
+	}
+}
+
+// the profile a call on endname to svcMeth follows.
+func (rn *Network) profileFor(endname interface{}, svcMeth string) *FaultProfile {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	for _, key := range []profileKey{{endname, svcMeth}, {endname, ""}, {nil, svcMeth}, {nil, ""}} {
+		if p, ok := rn.profiles[key]; ok {
+			return p
+		}
+	}
+	// Reliable() and LongReordering()
+	p := &FaultProfile{}
+	if !rn.reliable {
+		p.Latency = Uniform(0, 27*time.Millisecond)
+		p.DropRequests = 0.1
+		p.DropReplies = 0.1
+	}
+	if rn.longReordering {
+		p.Reorder = 600.0 / 900.0
+	}
+	return p
+}
+
+// whether something with probability p happens.
+func (rn *Network) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	rn.randMu.Lock()
+	defer rn.randMu.Unlock()
+	return rn.rand.Float64() < p
+}
+
+// a random int in [0, n).
+func (rn *Network) intn(n int) int {
+	rn.randMu.Lock()
+	defer rn.randMu.Unlock()
+	return rn.rand.Intn(n)
+}
+
+// a delay drawn from l, zero if l is nil.
+func (rn *Network) delay(l Latency) time.Duration {
+	if l == nil {
+		return 0
+	}
+	rn.randMu.Lock()
+	defer rn.randMu.Unlock()
+	return l.Sample(rn.rand)
+}
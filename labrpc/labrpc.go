@@ -17,13 +17,26 @@ package labrpc
 //
 // net := MakeNetwork() -- holds network, clients, servers.
 // end := net.MakeEnd(endname) -- create a client end-point, to talk to one server.
+// end := net.MakeEndFor(endname, servername) -- the same, for an end
+//   that servername sends on, see partition.go.
 // net.AddServer(servername, server) -- adds a named server to network.
 // net.DeleteServer(servername) -- eliminate the named server.
 // net.Connect(endname, servername) -- connect a client to a server.
 // net.Enable(endname, enabled) -- enable/disable a client.
 // net.Reliable(bool) -- false means drop/delay messages
+//   drawn from a source seeded from $LABRPC_SEED, or see
+//   MakeNetworkSeed(); net.Seed() tells which.
+// net.SetClock(clock) -- delay messages in simulated time, see labclock.
+// net.SetFaultProfile(endname, svcMeth, profile) -- finer grained
+//   drops, delays, duplicates and reordering, see faults.go.
+// net.Partition(group1, group2, ...), net.CutOneWay(from, to)
+//   -- see partition.go.
 //
 // end.Call("Raft.AppendEntries", &args, &reply) -- send an RPC, wait for reply.
+// end.CallErr("Raft.AppendEntries", &args, &reply) -- the same, but
+//   returns why it failed, e.g. ErrDropped, see errors.go.
+// end.CallContext(ctx, "Raft.AppendEntries", &args, &reply) -- like
+//   CallErr(), but gives up with ctx.Err() once ctx is done.
 // the "Raft" is the name of the server struct to be called.
 // the "AppendEntries" is the name of the method to be called.
 // Call() returns true to indicate that the server executed the request
@@ -40,6 +53,9 @@ package labrpc
 // the server RPC handler function must declare its args and reply arguments
 // as pointers, so that their types exactly match the types of the arguments
 // to Call().
+// a handler may take a context.Context first, as in
+//   func (rf *Raft) AppendEntries(ctx context.Context, args *Args, reply *Reply)
+// which is cancelled when the caller gives up, or the server is deleted.
 //
 // srv := MakeServer()
 // srv.AddService(svc) -- a server can have multiple services, e.g. Raft and k/v
@@ -49,24 +65,34 @@ package labrpc
 //   much like Go's rpcs.Register()
 //   pass svc to srv.AddService()
 //
+// tcp.go serves the same Servers, and makes ClientEnds, over TCP.
+// async.go has end.Go(), for calls that don't block, and Gather().
+//
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
+	"os"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"6.824-lab/labclock"
 	"6.824-lab/labgob"
 )
 
 type reqMsg struct {
-	endname  interface{} // name of sending ClientEnd
-	svcMeth  string      // e.g. "Raft.AppendEntries"
-	argsType reflect.Type
+	ctx      context.Context // the caller's
+	endname  interface{}     // name of sending ClientEnd
+	svcMeth  string          // e.g. "Raft.AppendEntries"
+	argsType reflect.Type    // nil for the handler's own, see tcp.go
 	args     []byte
 	replyCh  chan replyMsg
 }
@@ -74,22 +100,45 @@ type reqMsg struct {
 type replyMsg struct {
 	ok    bool
 	reply []byte
+	err   error // why not ok
 }
 type ClientEnd struct {
 	endname interface{}   // this end-point's name
 	ch      chan reqMsg   // copy of Network.endCh
 	done    chan struct{} // closed when Network is cleaned up
+	tcp     *tcpClient    // instead of ch, for MakeTCPEnd()
 }
 
+// no reply was received from the server. most errors in errors.go
+// say why, and match this one.
+var ErrNoReply = errors.New("labrpc: no reply")
+
 // send an RPC, wait for the reply.
 // the return value indicates success; false means that
 // no reply was received from the server.
 func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return e.CallContext(context.Background(), svcMeth, args, reply) == nil
+}
+
+// like Call(), but returns nil for success, or why there was no
+// reply, see errors.go.
+func (e *ClientEnd) CallErr(svcMeth string, args interface{}, reply interface{}) error {
+	return e.CallContext(context.Background(), svcMeth, args, reply)
+}
+
+// like CallErr(), but returns ctx.Err() as soon as ctx is done, and
+// the handler's context is cancelled.
+func (e *ClientEnd) CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+	if e.tcp != nil {
+		return e.tcp.call(ctx, svcMeth, args, reply)
+	}
+
 	req := reqMsg{}
+	req.ctx = ctx
 	req.endname = e.endname
 	req.svcMeth = svcMeth
 	req.argsType = reflect.TypeOf(args)
-	req.replyCh = make(chan replyMsg)
+	req.replyCh = make(chan replyMsg, 1) // the network must not wait for a caller that gave up
 
 	qb := new(bytes.Buffer)
 	qe := labgob.NewEncoder(qb)
@@ -104,44 +153,86 @@ func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bo
 		// the request has been sent.
 	case <-e.done:
 		// entire Network has been destroyed.
-		return false
+		return ErrNetworkClosed
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
-	rep := <-req.replyCh
+	var rep replyMsg
+	select {
+	case rep = <-req.replyCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-e.done:
+		return ErrNetworkClosed
+	}
 	if rep.ok {
 		rb := bytes.NewBuffer(rep.reply)
 		rd := labgob.NewDecoder(rb)
 		if err := rd.Decode(reply); err != nil {
-			log.Fatalf("ClientEnd.Call(): decode reply: %v\n", err)
+			return fmt.Errorf("%w: reply to %v: %v", ErrDecode, svcMeth, err)
 		}
-		return true
+		return nil
 	} else {
-		return false
+		return rep.err
 	}
 }
 
 type Network struct {
 	mu             sync.Mutex
 	reliable       bool
-	longDelays     bool                        // pause a long time on send on disabled connection
-	longReordering bool                        // sometimes delay replies a long time
-	ends           map[interface{}]*ClientEnd  // ends, by name
-	enabled        map[interface{}]bool        // by end name
-	servers        map[interface{}]*Server     // servers, by name
-	connections    map[interface{}]interface{} // endname -> servername
+	longDelays     bool                         // pause a long time on send on disabled connection
+	longReordering bool                         // sometimes delay replies a long time
+	ends           map[interface{}]*ClientEnd   // ends, by name
+	enabled        map[interface{}]bool         // by end name
+	servers        map[interface{}]*Server      // servers, by name
+	connections    map[interface{}]interface{}  // endname -> servername
+	owners         map[interface{}]interface{}  // endname -> servername it sends for
+	groups         [][]interface{}              // as passed to Partition()
+	group          map[interface{}]int          // servername -> index in groups, nil if healed
+	faults         map[[2]interface{}]LinkFault // {from, to} servernames -> fault
+	profiles       map[profileKey]*FaultProfile // see SetFaultProfile()
+	randMu         sync.Mutex
+	seed           int64
+	clock          labclock.Clock // for every delay, see SetClock()
+	rand           *rand.Rand     // every fault's randomness, under randMu
 	endCh          chan reqMsg
 	done           chan struct{} // closed when Network is cleaned up
 	count          int32         // total RPC count, for statistics
 	bytes          int64         // total bytes send, for statistics
 }
 
+// a Network draws every drop, delay and reordering from a source
+// seeded with this, if set, so a failing run can be replayed.
+const SeedEnv = "LABRPC_SEED"
+
+// seeded from $LABRPC_SEED, or at random; see Seed().
 func MakeNetwork() *Network {
+	seed := time.Now().UnixNano()
+	if s := os.Getenv(SeedEnv); s != "" {
+		var err error
+		if seed, err = strconv.ParseInt(s, 10, 64); err != nil {
+			log.Fatalf("MakeNetwork: bad %v %q: %v\n", SeedEnv, s, err)
+		}
+	}
+	return MakeNetworkSeed(seed)
+}
+
+// the same faults again, for the same seed and the same calls in
+// the same order; goroutine scheduling may still differ.
+func MakeNetworkSeed(seed int64) *Network {
 	rn := &Network{}
+	rn.seed = seed
 	rn.reliable = true
 	rn.ends = map[interface{}]*ClientEnd{}
 	rn.enabled = map[interface{}]bool{}
 	rn.servers = map[interface{}]*Server{}
 	rn.connections = map[interface{}](interface{}){}
+	rn.owners = map[interface{}](interface{}){}
+	rn.faults = map[[2]interface{}]LinkFault{}
+	rn.profiles = map[profileKey]*FaultProfile{}
+	rn.rand = rand.New(rand.NewSource(seed))
+	rn.clock = labclock.Real
 	rn.endCh = make(chan reqMsg)
 	rn.done = make(chan struct{})
 
@@ -162,6 +253,18 @@ func MakeNetwork() *Network {
 	return rn
 }
 
+// the seed the Network's faults are drawn with, to pass to
+// MakeNetworkSeed(), or $LABRPC_SEED, to replay them.
+func (rn *Network) Seed() int64 {
+	return rn.seed
+}
+
+// time the Network's delays and timeouts with clock, e.g. a
+// labclock.Sim; must be called before the first Call().
+func (rn *Network) SetClock(clock labclock.Clock) {
+	rn.clock = clock
+}
+
 func (rn *Network) Cleanup() {
 	close(rn.done)
 }
@@ -193,7 +296,7 @@ func (rn *Network) ReadEndnameInfo(endname interface{}) (enabled bool,
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	enabled = rn.enabled[endname]
+	enabled = rn.usable(endname)
 	servername = rn.connections[endname]
 	if servername != nil {
 		server = rn.servers[servername]
@@ -207,35 +310,50 @@ func (rn *Network) IsServerDead(endname interface{}, servername interface{}, ser
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	if rn.enabled[endname] == false || rn.servers[servername] != server {
+	if rn.usable(endname) == false || rn.servers[servername] != server {
 		return true
 	}
 	return false
 }
 
 func (rn *Network) ProcessReq(req reqMsg) {
-	enabled, servername, server, reliable, longreordering := rn.ReadEndnameInfo(req.endname)
+	enabled, servername, server, _, _ := rn.ReadEndnameInfo(req.endname)
+	fault := rn.linkFault(req.endname)
+	profile := rn.profileFor(req.endname, req.svcMeth)
 
-	if enabled && servername != nil && server != nil {
-		if reliable == false {
-			// short delay
-			ms := (rand.Int() % 27)
-			time.Sleep(time.Duration(ms) * time.Millisecond)
-		}
+	if enabled && servername != nil && server != nil && fault&DropRequests == 0 {
+		// short delay
+		rn.clock.Sleep(rn.delay(profile.Latency))
 
-		if reliable == false && (rand.Int()%1000) < 100 {
+		if rn.chance(profile.DropRequests) {
 			// drop the request, return as if timeout
-			req.replyCh <- replyMsg{false, nil}
+			req.replyCh <- replyMsg{false, nil, ErrRequestDropped}
 			return
 		}
 
+		if rn.chance(profile.Duplicate) {
+			// a second copy, a little later; nobody waits for its reply
+			dup := req
+			dup.ctx = context.Background()
+			d := rn.delay(profile.Latency)
+			rn.clock.AfterFunc(d, func() {
+				server.dispatch(dup)
+			})
+		}
+
 		// execute the request (call the RPC handler).
 		// in a separate thread so that we can periodically check
 		// if the server has been killed and the RPC should get a
 		// failure reply.
+		// the handler's context ends with the caller's, or when the
+		// server turns out to be dead.
+		hctx, cancel := context.WithCancel(req.ctx)
+		defer cancel()
+		hreq := req
+		hreq.ctx = hctx
 		ech := make(chan replyMsg)
 		go func() {
-			r := server.dispatch(req)
+			r := server.dispatch(hreq)
 			ech <- r
 		}()
 
@@ -245,17 +363,28 @@ func (rn *Network) ProcessReq(req reqMsg) {
 		var reply replyMsg
 		replyOK := false
 		serverDead := false
+		// stopped once done, a simulated clock would have to wait it out
+		poll := rn.clock.NewTimer(100 * time.Millisecond)
+		defer poll.Stop()
 		for replyOK == false && serverDead == false {
 			select {
 			case reply = <-ech:
 				replyOK = true
-			case <-time.After(100 * time.Millisecond):
+			case <-hctx.Done():
+				// the caller gave up, nobody waits for the reply
+				serverDead = true
+				go func() {
+					<-ech
+				}()
+			case <-poll.C():
 				serverDead = rn.IsServerDead(req.endname, servername, server)
 				if serverDead {
+					cancel()
 					go func() {
 						<-ech // drain channel to let the goroutine created earlier terminate
 					}()
 				}
+				poll.Reset(100 * time.Millisecond)
 			}
 		}
 
@@ -269,17 +398,23 @@ func (rn *Network) ProcessReq(req reqMsg) {
 
 		if replyOK == false || serverDead == true {
 			// server was killed while we were waiting; return error.
-			req.replyCh <- replyMsg{false, nil}
-		} else if reliable == false && (rand.Int()%1000) < 100 {
+			req.replyCh <- replyMsg{false, nil, ErrServerDead}
+		} else if rn.linkFault(req.endname)&DropReplies != 0 {
+			// the link lost the reply, the handler did run
+			req.replyCh <- replyMsg{false, nil, ErrReplyDropped}
+		} else if rn.chance(profile.DropReplies) {
 			// drop the reply, return as if timeout
-			req.replyCh <- replyMsg{false, nil}
-		} else if longreordering == true && rand.Intn(900) < 600 {
+			req.replyCh <- replyMsg{false, nil, ErrReplyDropped}
+		} else if rn.chance(profile.Reorder) {
 			// delay the response for a while
-			ms := 200 + rand.Intn(1+rand.Intn(2000))
+			delay := profile.ReorderDelay
+			if delay == nil {
+				delay = reorderDelay{}
+			}
 			// Russ points out that this timer arrangement will decrease
 			// the number of goroutines, so that the race
 			// detector is less likely to get upset.
-			time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+			rn.clock.AfterFunc(rn.delay(delay), func() {
 				atomic.AddInt64(&rn.bytes, int64(len(reply.reply)))
 				req.replyCh <- reply
 			})
@@ -293,14 +428,22 @@ func (rn *Network) ProcessReq(req reqMsg) {
 		if rn.longDelays {
 			// let Raft tests check that leader doesn't send
 			// RPCs synchronously.
-			ms = (rand.Int() % 7000)
+			ms = rn.intn(7000)
 		} else {
 			// many kv tests require the client to try each
 			// server in fairly rapid succession.
-			ms = (rand.Int() % 100)
+			ms = rn.intn(100)
+		}
+		err := ErrUnreachable
+		if enabled && servername != nil {
+			err = ErrServerDead
+			if server != nil {
+				// the link dropped the request
+				err = ErrRequestDropped
+			}
 		}
-		time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
-			req.replyCh <- replyMsg{false, nil}
+		rn.clock.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+			req.replyCh <- replyMsg{false, nil, err}
 		})
 	}
 
@@ -308,7 +451,15 @@ func (rn *Network) ProcessReq(req reqMsg) {
 
 // create a client end-point.
 // start the thread that listens and delivers.
+// it belongs to no server, e.g. it's a clerk's, and ignores
+// partitions and link faults.
 func (rn *Network) MakeEnd(endname interface{}) *ClientEnd {
+	return rn.MakeEndFor(endname, nil)
+}
+
+// like MakeEnd(), for an end that servername sends on, so that
+// partitions and link faults between servers apply to it.
+func (rn *Network) MakeEndFor(endname interface{}, servername interface{}) *ClientEnd {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
@@ -319,9 +470,11 @@ func (rn *Network) MakeEnd(endname interface{}) *ClientEnd {
 	e := &ClientEnd{}
 	e.endname = endname
 	e.ch = rn.endCh
+	e.done = rn.done
 	rn.ends[endname] = e
 	rn.enabled[endname] = false
 	rn.connections[endname] = nil
+	rn.owners[endname] = servername
 
 	return e
 }
@@ -406,6 +559,11 @@ func (rs *Server) dispatch(req reqMsg) replyMsg {
 
 	// split Raft.AppendEntries into service and method
 	dot := strings.LastIndex(req.svcMeth, ".")
+	if dot < 0 {
+		rs.mu.Unlock()
+		err := fmt.Errorf("%w: %q is not Service.Method", ErrUnknownMethod, req.svcMeth)
+		return replyMsg{false, nil, err}
+	}
 	serviceName := req.svcMeth[:dot]
 	methodName := req.svcMeth[dot+1:]
 
@@ -420,9 +578,9 @@ func (rs *Server) dispatch(req reqMsg) replyMsg {
 		for k, _ := range rs.services {
 			choices = append(choices, k)
 		}
-		log.Fatalf("labrpc.Server.dispatch(): unknown service %v in %v.%v; expecting one of %v\n",
-			serviceName, serviceName, methodName, choices)
-		return replyMsg{false, nil}
+		err := fmt.Errorf("%w: unknown service %v in %v.%v; expecting one of %v",
+			ErrUnknownMethod, serviceName, serviceName, methodName, choices)
+		return replyMsg{false, nil, err}
 	}
 }
 
@@ -456,10 +614,17 @@ func MakeService(rcvr interface{}) *Service {
 		//fmt.Printf("%v pp %v ni %v 1k %v 2k %v no %v\n",
 		//	mname, method.PkgPath, mtype.NumIn(), mtype.In(1).Kind(), mtype.In(2).Kind(), mtype.NumOut())
 
+		// a context.Context may come before args
+		ctxArg := mtype.NumIn() == 4 && mtype.In(1) == contextType
+		nin := 3
+		if ctxArg {
+			nin = 4
+		}
+
 		if method.PkgPath != "" || // capitalized?
-			mtype.NumIn() != 3 ||
-			//mtype.In(1).Kind() != reflect.Ptr ||
-			mtype.In(2).Kind() != reflect.Ptr ||
+			mtype.NumIn() != nin ||
+			//mtype.In(nin-2).Kind() != reflect.Ptr ||
+			mtype.In(nin-1).Kind() != reflect.Ptr ||
 			mtype.NumOut() != 0 {
 			// the method is not suitable for a handler
 			//fmt.Printf("bad method: %v\n", mname)
@@ -472,39 +637,60 @@ func MakeService(rcvr interface{}) *Service {
 	return svc
 }
 
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
 	if method, ok := svc.methods[methname]; ok {
+		// args and reply are the last two arguments, after the
+		// receiver and maybe a context.
+		nin := method.Type.NumIn()
+
 		// prepare space into which to read the argument.
 		// the Value's type will be a pointer to req.argsType.
-		args := reflect.New(req.argsType)
+		argsType := req.argsType
+		if argsType == nil {
+			argsType = method.Type.In(nin - 2)
+		}
+		args := reflect.New(argsType)
 
 		// decode the argument.
 		ab := bytes.NewBuffer(req.args)
 		ad := labgob.NewDecoder(ab)
-		ad.Decode(args.Interface())
+		if err := ad.Decode(args.Interface()); err != nil {
+			err = fmt.Errorf("%w: args of %v: %v", ErrDecode, req.svcMeth, err)
+			return replyMsg{false, nil, err}
+		}
 
 		// allocate space for the reply.
-		replyType := method.Type.In(2)
+		replyType := method.Type.In(nin - 1)
 		replyType = replyType.Elem()
 		replyv := reflect.New(replyType)
 
 		// call the method.
 		function := method.Func
-		function.Call([]reflect.Value{svc.rcvr, args.Elem(), replyv})
+		if nin == 4 {
+			ctx := req.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			function.Call([]reflect.Value{svc.rcvr, reflect.ValueOf(ctx), args.Elem(), replyv})
+		} else {
+			function.Call([]reflect.Value{svc.rcvr, args.Elem(), replyv})
+		}
 
 		// encode the reply.
 		rb := new(bytes.Buffer)
 		re := labgob.NewEncoder(rb)
 		re.EncodeValue(replyv)
 
-		return replyMsg{true, rb.Bytes()}
+		return replyMsg{true, rb.Bytes(), nil}
 	} else {
 		choices := []string{}
 		for k, _ := range svc.methods {
 			choices = append(choices, k)
 		}
-		log.Fatalf("labrpc.Service.dispatch(): unknown method %v in %v; expecting one of %v\n",
-			methname, req.svcMeth, choices)
-		return replyMsg{false, nil}
+		err := fmt.Errorf("%w: unknown method %v in %v; expecting one of %v",
+			ErrUnknownMethod, methname, req.svcMeth, choices)
+		return replyMsg{false, nil, err}
 	}
 }
@@ -0,0 +1,203 @@
+package labrpc
+
+//
+// partitions: which servers can reach which, as a whole, rather
+// than one Enable() per ClientEnd.
+//
+// net.MakeEndFor(endname, servername) -- an end that sends on
+//   behalf of servername. ends from MakeEnd() have no owner, e.g.
+//   clerks', and ignore partitions.
+// net.Partition(group1, group2, ...) -- servers only reach servers
+//   in their own group; a server in no group reaches nobody. each
+//   group is a []interface{} of servernames. takes effect at once,
+//   for calls in flight too.
+// net.SetLinkFault(from, to, fault) -- fail calls from server from
+//   to server to in one direction only: DropRequests, DropReplies
+//   (the handler runs, the caller never hears), or LinkDown for both.
+//   LinkOK clears it.
+// net.CutOneWay(from, to) -- nothing from gets to to: from's calls
+//   to to are dropped, and so are its replies to to's calls. to's
+//   calls still reach from.
+// net.RestoreOneWay(from, to) -- undo CutOneWay(from, to), leaving
+//   any other faults on the two links.
+// net.Heal() -- everyone reaches everyone again, link faults cleared.
+// net.Groups() -- the groups of the current partition, nil if none.
+// net.Reachable(from, to) -- whether from owns an enabled end to to
+//   that the partition and link faults let through.
+// net.Topology() -- for every server that owns ends, the servers
+//   Reachable() from it.
+//
+// Enable() still applies on top: a call gets through only if its
+// end is enabled and the partition allows it.
+//
+
+import (
+	"fmt"
+	"sort"
+)
+
+// on the link from one server to another.
+type LinkFault int
+
+const LinkOK LinkFault = 0
+
+const (
+	DropRequests LinkFault = 1 << iota // calls never arrive
+	DropReplies                        // calls run, but their replies are lost
+	LinkDown     = DropRequests | DropReplies
+)
+
+func (rn *Network) Partition(groups ...[]interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.groups = groups
+	rn.group = map[interface{}]int{}
+	for g, servers := range groups {
+		for _, servername := range servers {
+			if _, ok := rn.group[servername]; ok {
+				panic(fmt.Sprintf("Partition: %v is in more than one group", servername))
+			}
+			rn.group[servername] = g
+		}
+	}
+}
+
+func (rn *Network) SetLinkFault(from interface{}, to interface{}, fault LinkFault) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.setLinkFault(from, to, fault)
+}
+
+func (rn *Network) GetLinkFault(from interface{}, to interface{}) LinkFault {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	return rn.faults[[2]interface{}{from, to}]
+}
+
+func (rn *Network) CutOneWay(from interface{}, to interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.setLinkFault(from, to, rn.faults[[2]interface{}{from, to}]|DropRequests)
+	rn.setLinkFault(to, from, rn.faults[[2]interface{}{to, from}]|DropReplies)
+}
+
+func (rn *Network) RestoreOneWay(from interface{}, to interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.setLinkFault(from, to, rn.faults[[2]interface{}{from, to}]&^DropRequests)
+	rn.setLinkFault(to, from, rn.faults[[2]interface{}{to, from}]&^DropReplies)
+}
+
+// should be called when holding the lock
+func (rn *Network) setLinkFault(from interface{}, to interface{}, fault LinkFault) {
+	if fault == LinkOK {
+		delete(rn.faults, [2]interface{}{from, to})
+	} else {
+		rn.faults[[2]interface{}{from, to}] = fault
+	}
+}
+
+func (rn *Network) Heal() {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.groups = nil
+	rn.group = nil
+	rn.faults = map[[2]interface{}]LinkFault{}
+}
+
+func (rn *Network) Groups() [][]interface{} {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	if rn.group == nil {
+		return nil
+	}
+	groups := make([][]interface{}, len(rn.groups))
+	for g, servers := range rn.groups {
+		groups[g] = append([]interface{}{}, servers...)
+	}
+	return groups
+}
+
+func (rn *Network) Reachable(from interface{}, to interface{}) bool {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	for endname, owner := range rn.owners {
+		if owner == from && rn.connections[endname] == to && rn.usable(endname) &&
+			rn.faults[[2]interface{}{from, to}] == LinkOK {
+			return true
+		}
+	}
+	return false
+}
+
+func (rn *Network) Topology() map[interface{}][]interface{} {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	topo := map[interface{}][]interface{}{}
+	seen := map[[2]interface{}]bool{}
+	for endname, from := range rn.owners {
+		if from == nil {
+			continue
+		}
+		if _, ok := topo[from]; !ok {
+			topo[from] = []interface{}{}
+		}
+		to := rn.connections[endname]
+		if to == nil || seen[[2]interface{}{from, to}] || !rn.usable(endname) ||
+			rn.faults[[2]interface{}{from, to}] != LinkOK {
+			continue
+		}
+		seen[[2]interface{}{from, to}] = true
+		topo[from] = append(topo[from], to)
+	}
+	for from := range topo {
+		sortNames(topo[from])
+	}
+	return topo
+}
+
+// should be called when holding the lock. whether a call on
+// endname gets through, as far as Enable() and the partition go.
+func (rn *Network) usable(endname interface{}) bool {
+	return rn.enabled[endname] && rn.linked(endname)
+}
+
+// should be called when holding the lock. whether the partition
+// lets endname's owner reach the server it's connected to.
+func (rn *Network) linked(endname interface{}) bool {
+	owner := rn.owners[endname]
+	if rn.group == nil || owner == nil {
+		return true
+	}
+	from, ok1 := rn.group[owner]
+	to, ok2 := rn.group[rn.connections[endname]]
+	return ok1 && ok2 && from == to
+}
+
+// the fault on the link a call on endname takes.
+func (rn *Network) linkFault(endname interface{}) LinkFault {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	owner := rn.owners[endname]
+	if owner == nil {
+		return LinkOK
+	}
+	return rn.faults[[2]interface{}{owner, rn.connections[endname]}]
+}
+
+// servernames may be of any type, so order them by how they print.
+func sortNames(names []interface{}) {
+	sort.Slice(names, func(i, j int) bool {
+		return fmt.Sprint(names[i]) < fmt.Sprint(names[j])
+	})
+}
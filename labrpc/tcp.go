@@ -0,0 +1,489 @@
+package labrpc
+
+//
+// the same RPCs over real TCP connections, for running outside
+// the simulated Network.
+//
+// l, err := srv.ListenTCP(addr) -- serve srv's services on addr.
+//   l.Addr() is the address it listens on, l.Close() stops it.
+// end := MakeTCPEnd(addr, opts) -- a ClientEnd that dials addr.
+//   end.Call() works as for a Network's ends; false now also means
+//   the call timed out (ErrDropped) or its connection broke
+//   (ErrServerDead). calls are spread
+//   over a small pool of connections, each carrying any number of
+//   calls at once; a broken connection is redialed on the next call.
+//   a call whose request never reached the server, because its
+//   pooled connection was already broken or closing, is retried
+//   once on a fresh dial, so a closed server reports ErrUnreachable.
+// end.Close() -- close the end's connections.
+//
+// requests and replies are labgob-encoded, and dispatched to
+// services exactly as Network requests are. a call that gives up
+// (CallContext()'s ctx, or CallTimeout) tells the server, which
+// cancels the handler's context; so does a closed connection.
+// a closing listener stops reading each connection and says goodbye,
+// naming the requests it read but hasn't answered; the client knows
+// the rest never ran.
+//
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"6.824-lab/labgob"
+)
+
+type TCPOptions struct {
+	Conns       int           // connections per end
+	CallTimeout time.Duration // Call() gives up after this long, 0 for never
+	DialTimeout time.Duration
+}
+
+func DefaultTCPOptions() TCPOptions {
+	return TCPOptions{
+		Conns:       2,
+		CallTimeout: 2 * time.Second,
+		DialTimeout: time.Second,
+	}
+}
+
+// on the wire, Seq matches replies to calls on a connection.
+type tcpRequest struct {
+	Seq     uint64
+	SvcMeth string
+	Args    []byte
+	Cancel  bool // the caller of Seq gave up, no Args
+}
+
+type tcpReply struct {
+	Seq     uint64 // 0 for the server's goodbye, see serveConn()
+	OK      bool
+	Reply   []byte
+	Err     int // why not OK, see encodeError()
+	ErrMsg  string
+	Running []uint64 // goodbye only: requests read but not answered
+	Unsent  bool     // never on the wire: the server didn't read Seq
+}
+
+//
+// client side
+//
+
+type tcpClient struct {
+	addr   string
+	opts   TCPOptions
+	seq    uint64 // atomic
+	mu     sync.Mutex
+	conns  []*tcpConn // nil or broken slots are redialed
+	next   int        // round robin over conns
+	closed bool
+}
+
+// one connection, carrying many calls.
+type tcpConn struct {
+	conn    net.Conn
+	wmu     sync.Mutex // serializes requests
+	w       *bufio.Writer
+	enc     *labgob.LabEncoder
+	mu      sync.Mutex
+	pending map[uint64]chan tcpReply // closed if the connection breaks
+	broken  bool
+}
+
+func MakeTCPEnd(addr string, opts TCPOptions) *ClientEnd {
+	if opts.Conns < 1 {
+		opts.Conns = 1
+	}
+	c := &tcpClient{addr: addr, opts: opts}
+	c.conns = make([]*tcpConn, opts.Conns)
+	return &ClientEnd{endname: addr, tcp: c}
+}
+
+// close the end's connections; later calls fail.
+func (e *ClientEnd) Close() {
+	if e.tcp == nil {
+		return
+	}
+	e.tcp.mu.Lock()
+	defer e.tcp.mu.Unlock()
+	e.tcp.closed = true
+	for _, tc := range e.tcp.conns {
+		if tc != nil {
+			tc.fail()
+		}
+	}
+}
+
+func (c *tcpClient) call(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+	qb := new(bytes.Buffer)
+	qe := labgob.NewEncoder(qb)
+	qe.Encode(args)
+
+	var timeout <-chan time.Time // nil, never fires, for no CallTimeout
+	if c.opts.CallTimeout > 0 {
+		timer := time.NewTimer(c.opts.CallTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	slot := c.nextSlot()
+	for retried := false; ; retried = true {
+		tc, err := c.conn(ctx, slot)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		seq := atomic.AddUint64(&c.seq, 1)
+		ch := make(chan tcpReply, 1)
+		if !tc.register(seq, ch) || !tc.send(tcpRequest{Seq: seq, SvcMeth: svcMeth, Args: qb.Bytes()}) {
+			// the request didn't go out whole, and the
+			// connection is broken now; redial slot once.
+			if !retried {
+				continue
+			}
+			return c.brokenErr()
+		}
+
+		select {
+		case rep, ok := <-ch:
+			if !ok {
+				return c.brokenErr()
+			}
+			if rep.Unsent {
+				if !retried {
+					continue
+				}
+				return c.brokenErr()
+			}
+			if !rep.OK {
+				return decodeError(rep.Err, rep.ErrMsg)
+			}
+			rd := labgob.NewDecoder(bytes.NewBuffer(rep.Reply))
+			if err := rd.Decode(reply); err != nil {
+				return fmt.Errorf("%w: reply to %v: %v", ErrDecode, svcMeth, err)
+			}
+			return nil
+		case <-timeout:
+			tc.giveUp(seq)
+			return ErrDropped
+		case <-ctx.Done():
+			tc.giveUp(seq)
+			return ctx.Err()
+		}
+	}
+}
+
+// why a call's connection failed under it.
+func (c *tcpClient) brokenErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrNetworkClosed
+	}
+	return ErrServerDead
+}
+
+// round robin over the pool.
+func (c *tcpClient) nextSlot() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	slot := c.next
+	c.next = (c.next + 1) % len(c.conns)
+	return slot
+}
+
+// slot's connection, dialing it if need be.
+func (c *tcpClient) conn(ctx context.Context, slot int) (*tcpConn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrNetworkClosed
+	}
+	if tc := c.conns[slot]; tc != nil && !tc.isBroken() {
+		c.mu.Unlock()
+		return tc, nil
+	}
+	c.mu.Unlock()
+
+	// dial without the lock, other slots stay usable meanwhile
+	d := net.Dialer{Timeout: c.opts.DialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnreachable, err)
+	}
+	tc := newTCPConn(conn)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old := c.conns[slot]; c.closed || (old != nil && !old.isBroken()) {
+		// closed, or another call redialed first
+		tc.fail()
+		if c.closed {
+			return nil, ErrNetworkClosed
+		}
+		return old, nil
+	}
+	c.conns[slot] = tc
+	go tc.readReplies()
+	return tc, nil
+}
+
+func newTCPConn(conn net.Conn) *tcpConn {
+	tc := &tcpConn{conn: conn}
+	tc.w = bufio.NewWriter(conn)
+	tc.enc = labgob.NewEncoder(tc.w)
+	tc.pending = map[uint64]chan tcpReply{}
+	return tc
+}
+
+func (tc *tcpConn) isBroken() bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.broken
+}
+
+func (tc *tcpConn) register(seq uint64, ch chan tcpReply) bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.broken {
+		return false
+	}
+	tc.pending[seq] = ch
+	return true
+}
+
+// stop waiting for seq, and have the server cancel its handler.
+func (tc *tcpConn) giveUp(seq uint64) {
+	tc.mu.Lock()
+	delete(tc.pending, seq)
+	tc.mu.Unlock()
+	go tc.send(tcpRequest{Seq: seq, Cancel: true})
+}
+
+func (tc *tcpConn) send(req tcpRequest) bool {
+	tc.wmu.Lock()
+	defer tc.wmu.Unlock()
+	if err := tc.enc.Encode(req); err != nil {
+		tc.fail()
+		return false
+	}
+	if err := tc.w.Flush(); err != nil {
+		tc.fail()
+		return false
+	}
+	return true
+}
+
+// readReplies hands replies to their calls until the connection breaks
+func (tc *tcpConn) readReplies() {
+	dec := labgob.NewDecoder(bufio.NewReader(tc.conn))
+	for {
+		var rep tcpReply
+		if err := dec.Decode(&rep); err != nil {
+			tc.fail()
+			return
+		}
+		if rep.Seq == 0 {
+			tc.failUnsent(rep.Running)
+			return
+		}
+		tc.mu.Lock()
+		ch, ok := tc.pending[rep.Seq]
+		delete(tc.pending, rep.Seq)
+		tc.mu.Unlock()
+		if ok {
+			ch <- rep
+		}
+	}
+}
+
+// close the connection and fail every call waiting on it.
+func (tc *tcpConn) fail() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.broken {
+		return
+	}
+	tc.broken = true
+	tc.conn.Close()
+	for seq, ch := range tc.pending {
+		close(ch)
+		delete(tc.pending, seq)
+	}
+}
+
+// after the server's goodbye: fail the calls it was running, and
+// tell the others their request was never read.
+func (tc *tcpConn) failUnsent(running []uint64) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.broken {
+		return
+	}
+	tc.broken = true
+	tc.conn.Close()
+	ran := map[uint64]bool{}
+	for _, seq := range running {
+		ran[seq] = true
+	}
+	for seq, ch := range tc.pending {
+		if ran[seq] {
+			close(ch)
+		} else {
+			ch <- tcpReply{Seq: seq, Unsent: true}
+		}
+		delete(tc.pending, seq)
+	}
+}
+
+//
+// server side
+//
+
+type TCPListener struct {
+	rs     *Server
+	l      net.Listener
+	mu     sync.Mutex
+	conns  map[net.Conn]chan struct{} // closed when serveConn() returns
+	closed bool
+}
+
+// serve rs's services on addr, e.g. "127.0.0.1:0".
+func (rs *Server) ListenTCP(addr string) (*TCPListener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tl := &TCPListener{rs: rs, l: l, conns: map[net.Conn]chan struct{}{}}
+	go tl.serve()
+	return tl, nil
+}
+
+// the address it listens on, with the port filled in.
+func (tl *TCPListener) Addr() string {
+	return tl.l.Addr().String()
+}
+
+// stop listening and close every connection. returns once each
+// connection has stopped reading requests and said goodbye.
+func (tl *TCPListener) Close() error {
+	tl.mu.Lock()
+	tl.closed = true
+	err := tl.l.Close()
+	conns := tl.conns
+	tl.conns = map[net.Conn]chan struct{}{}
+	tl.mu.Unlock()
+	for conn, done := range conns {
+		conn.SetReadDeadline(time.Now()) // ends serveConn()'s loop
+		<-done
+	}
+	return err
+}
+
+func (tl *TCPListener) serve() {
+	for {
+		conn, err := tl.l.Accept()
+		if err != nil {
+			return
+		}
+		tl.mu.Lock()
+		if tl.closed {
+			tl.mu.Unlock()
+			conn.Close()
+			return
+		}
+		done := make(chan struct{})
+		tl.conns[conn] = done
+		tl.mu.Unlock()
+		go tl.serveConn(conn, done)
+	}
+}
+
+// serveConn runs every request on conn in its own goroutine, so
+// a slow handler doesn't hold up the calls behind it. once it stops
+// reading, it sends a goodbye (Seq 0) listing the requests whose
+// handlers haven't replied; the client knows the rest never ran.
+func (tl *TCPListener) serveConn(conn net.Conn, done chan struct{}) {
+	// every handler's context ends with the connection
+	connCtx, cancelAll := context.WithCancel(context.Background())
+	defer func() {
+		cancelAll()
+		tl.mu.Lock()
+		delete(tl.conns, conn)
+		tl.mu.Unlock()
+		conn.Close()
+		close(done)
+	}()
+
+	var mu sync.Mutex
+	cancels := map[uint64]context.CancelFunc{} // read, not yet answered
+
+	var wmu sync.Mutex // held from reply to leaving cancels
+	w := bufio.NewWriter(conn)
+	enc := labgob.NewEncoder(w)
+	dec := labgob.NewDecoder(bufio.NewReader(conn))
+	defer func() {
+		wmu.Lock()
+		mu.Lock()
+		bye := tcpReply{}
+		for seq := range cancels {
+			bye.Running = append(bye.Running, seq)
+		}
+		mu.Unlock()
+		if enc.Encode(bye) == nil && w.Flush() == nil {
+			// let the client hang up first, so requests it sent
+			// meanwhile don't reset the connection under the goodbye.
+			if tc, ok := conn.(*net.TCPConn); ok {
+				tc.CloseWrite()
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			io.Copy(io.Discard, conn)
+		}
+		wmu.Unlock()
+	}()
+	for {
+		var req tcpRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		if req.Cancel {
+			mu.Lock()
+			if cancel, ok := cancels[req.Seq]; ok {
+				cancel()
+			}
+			mu.Unlock()
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(connCtx)
+		mu.Lock()
+		cancels[req.Seq] = cancel
+		mu.Unlock()
+		go func() {
+			// argsType is left nil, the service takes it from the handler
+			r := tl.rs.dispatch(reqMsg{ctx: ctx, svcMeth: req.SvcMeth, args: req.Args})
+			cancel()
+			wmu.Lock()
+			defer wmu.Unlock()
+			rep := tcpReply{Seq: req.Seq, OK: r.ok, Reply: r.reply}
+			rep.Err, rep.ErrMsg = encodeError(r.err)
+			if enc.Encode(rep) == nil {
+				w.Flush()
+			}
+			// only now, so a goodbye either follows this reply or
+			// lists req.Seq as running.
+			mu.Lock()
+			delete(cancels, req.Seq)
+			mu.Unlock()
+		}()
+	}
+}
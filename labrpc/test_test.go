@@ -1,11 +1,15 @@
 package labrpc
 
 import "testing"
+import "context"
+import "errors"
 import "strconv"
 import "sync"
 import "runtime"
 import "time"
 import "fmt"
+import "math/rand"
+import "6.824-lab/labclock"
 
 type JunkArgs struct {
 	X int
@@ -516,3 +520,902 @@ func TestBenchmark(t *testing.T) {
 	fmt.Printf("%v for %v\n", time.Since(t0), n)
 	// march 2016, rtm laptop, 22 microseconds per RPC
 }
+
+func makeTCPServer(t *testing.T, addr string) (*JunkServer, *TCPListener) {
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	l, err := rs.ListenTCP(addr)
+	if err != nil {
+		t.Fatalf("ListenTCP(%v): %v", addr, err)
+	}
+	return js, l
+}
+
+func TestTCPBasic(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	_, l := makeTCPServer(t, "127.0.0.1:0")
+	defer l.Close()
+	e := MakeTCPEnd(l.Addr(), DefaultTCPOptions())
+	defer e.Close()
+
+	{
+		reply := ""
+		if !e.Call("JunkServer.Handler2", 111, &reply) || reply != "handler2-111" {
+			t.Fatalf("wrong reply from Handler2")
+		}
+	}
+
+	{
+		reply := 0
+		if !e.Call("JunkServer.Handler1", "9099", &reply) || reply != 9099 {
+			t.Fatalf("wrong reply from Handler1")
+		}
+	}
+
+	{
+		var args JunkArgs
+		var reply JunkReply
+		if !e.Call("JunkServer.Handler4", &args, &reply) || reply.X != "pointer" {
+			t.Fatalf("wrong reply from Handler4")
+		}
+	}
+
+	{
+		var args JunkArgs
+		var reply JunkReply
+		if !e.Call("JunkServer.Handler5", args, &reply) || reply.X != "no pointer" {
+			t.Fatalf("wrong reply from Handler5")
+		}
+	}
+}
+
+// many concurrent calls share one connection.
+func TestTCPConcurrent(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	js, l := makeTCPServer(t, "127.0.0.1:0")
+	defer l.Close()
+	opts := DefaultTCPOptions()
+	opts.Conns = 1
+	e := MakeTCPEnd(l.Addr(), opts)
+	defer e.Close()
+
+	nclients := 20
+	nrpcs := 50
+	ch := make(chan bool)
+	for ii := 0; ii < nclients; ii++ {
+		go func(i int) {
+			ok := true
+			for j := 0; j < nrpcs; j++ {
+				arg := i*100 + j
+				reply := ""
+				if !e.Call("JunkServer.Handler2", arg, &reply) ||
+					reply != "handler2-"+strconv.Itoa(arg) {
+					ok = false
+				}
+			}
+			ch <- ok
+		}(ii)
+	}
+	for ii := 0; ii < nclients; ii++ {
+		if !<-ch {
+			t.Fatalf("wrong reply from Handler2")
+		}
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if len(js.log2) != nclients*nrpcs {
+		t.Fatalf("server saw %v calls, expected %v", len(js.log2), nclients*nrpcs)
+	}
+}
+
+func TestTCPTimeout(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	_, l := makeTCPServer(t, "127.0.0.1:0")
+	defer l.Close()
+	opts := DefaultTCPOptions()
+	opts.CallTimeout = 200 * time.Millisecond
+	e := MakeTCPEnd(l.Addr(), opts)
+	defer e.Close()
+
+	t0 := time.Now()
+	reply := 0
+	if e.Call("JunkServer.Handler3", 99, &reply) {
+		t.Fatalf("Handler3 returned before it should have")
+	}
+	if d := time.Since(t0); d > time.Second {
+		t.Fatalf("call took %v to time out", d)
+	}
+}
+
+// zero TCPOptions mean no CallTimeout, not an instant one.
+func TestTCPZeroOptions(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	_, l := makeTCPServer(t, "127.0.0.1:0")
+	defer l.Close()
+	e := MakeTCPEnd(l.Addr(), TCPOptions{})
+	defer e.Close()
+
+	for i := 0; i < 20; i++ {
+		reply := ""
+		if err := e.CallErr("JunkServer.Handler2", i, &reply); err != nil ||
+			reply != "handler2-"+strconv.Itoa(i) {
+			t.Fatalf("wrong reply %v from Handler2, err %v", reply, err)
+		}
+	}
+
+	// still only as patient as the caller's ctx
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	reply := 0
+	if err := e.CallContext(ctx, "JunkServer.Handler3", 99, &reply); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Handler3 returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+}
+
+// a restarted server is redialed, a dead one fails calls.
+func TestTCPReconnect(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	_, l := makeTCPServer(t, "127.0.0.1:0")
+	addr := l.Addr()
+	e := MakeTCPEnd(addr, DefaultTCPOptions())
+	defer e.Close()
+
+	reply := ""
+	if !e.Call("JunkServer.Handler2", 1, &reply) {
+		t.Fatalf("call failed")
+	}
+
+	l.Close()
+	for i := 0; i < 4; i++ {
+		if e.Call("JunkServer.Handler2", 2, &reply) {
+			t.Fatalf("call succeeded with the server gone")
+		}
+	}
+
+	_, l = makeTCPServer(t, addr)
+	defer l.Close()
+	for i := 0; i < 4; i++ {
+		reply = ""
+		if !e.Call("JunkServer.Handler2", 3, &reply) || reply != "handler2-3" {
+			t.Fatalf("call failed after the server came back")
+		}
+	}
+}
+
+// handlers that take a context.
+type CtxServer struct {
+	cancelled chan bool // gets whether Wait's context was cancelled
+}
+
+// wait for the context to end, or a long time.
+func (cs *CtxServer) Wait(ctx context.Context, args int, reply *int) {
+	select {
+	case <-ctx.Done():
+		cs.cancelled <- true
+	case <-time.After(10 * time.Second):
+		cs.cancelled <- false
+	}
+	*reply = args
+}
+
+func (cs *CtxServer) Echo(ctx context.Context, args int, reply *int) {
+	*reply = args
+}
+
+func makeCtxNetwork() (*Network, *ClientEnd, *CtxServer) {
+	rn := MakeNetwork()
+	e := rn.MakeEndFor("end1-99", "client99")
+	cs := &CtxServer{cancelled: make(chan bool, 1)}
+	rs := MakeServer()
+	rs.AddService(MakeService(cs))
+	rn.AddServer("server99", rs)
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+	return rn, e, cs
+}
+
+func TestCallContext(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn, e, cs := makeCtxNetwork()
+	defer rn.Cleanup()
+
+	reply := 0
+	if err := e.CallContext(context.Background(), "CtxServer.Echo", 7, &reply); err != nil || reply != 7 {
+		t.Fatalf("Echo returned %v, %v", reply, err)
+	}
+
+	// the caller gives up, and so does the handler.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	if err := e.CallContext(ctx, "CtxServer.Wait", 1, &reply); err != context.DeadlineExceeded {
+		t.Fatalf("CallContext returned %v, expected DeadlineExceeded", err)
+	}
+	if d := time.Since(t0); d > time.Second {
+		t.Fatalf("CallContext took %v to give up", d)
+	}
+	select {
+	case c := <-cs.cancelled:
+		if !c {
+			t.Fatalf("handler's context was not cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("handler's context was not cancelled")
+	}
+}
+
+func TestCallContextDeleteServer(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn, e, cs := makeCtxNetwork()
+	defer rn.Cleanup()
+
+	errCh := make(chan error)
+	go func() {
+		reply := 0
+		errCh <- e.CallContext(context.Background(), "CtxServer.Wait", 1, &reply)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	rn.DeleteServer("server99")
+
+	select {
+	case c := <-cs.cancelled:
+		if !c {
+			t.Fatalf("handler's context was not cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("handler's context was not cancelled by DeleteServer()")
+	}
+	if err := <-errCh; !errors.Is(err, ErrServerDead) || !errors.Is(err, ErrNoReply) {
+		t.Fatalf("CallContext returned %v, expected ErrServerDead", err)
+	}
+}
+
+// with LongDelays, a disabled end's Call() may take seconds.
+func TestCallContextLongDelays(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn, e, _ := makeCtxNetwork()
+	defer rn.Cleanup()
+	rn.LongDelays(true)
+	rn.Enable("end1-99", false)
+
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		t0 := time.Now()
+		reply := 0
+		err := e.CallContext(ctx, "CtxServer.Echo", 1, &reply)
+		cancel()
+		if err == nil {
+			t.Fatalf("call through a disabled end succeeded")
+		}
+		if d := time.Since(t0); d > 500*time.Millisecond {
+			t.Fatalf("CallContext took %v to give up", d)
+		}
+	}
+}
+
+func TestTCPCallContext(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	cs := &CtxServer{cancelled: make(chan bool, 1)}
+	rs := MakeServer()
+	rs.AddService(MakeService(cs))
+	l, err := rs.ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenTCP: %v", err)
+	}
+	defer l.Close()
+	e := MakeTCPEnd(l.Addr(), DefaultTCPOptions())
+	defer e.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	reply := 0
+	if err := e.CallContext(ctx, "CtxServer.Wait", 1, &reply); err != context.DeadlineExceeded {
+		t.Fatalf("CallContext returned %v, expected DeadlineExceeded", err)
+	}
+	select {
+	case c := <-cs.cancelled:
+		if !c {
+			t.Fatalf("handler's context was not cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("handler's context was not cancelled")
+	}
+}
+
+func TestCallErr(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("server99", rs)
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	check := func(what string, err error, expected error) {
+		if !errors.Is(err, expected) || !errors.Is(err, ErrNoReply) {
+			t.Fatalf("%v returned %v, expected %v", what, err, expected)
+		}
+	}
+	// the server answered these, so they aren't ErrNoReply.
+	checkReplied := func(what string, err error, expected error) {
+		if !errors.Is(err, expected) || errors.Is(err, ErrNoReply) {
+			t.Fatalf("%v returned %v, expected %v but not ErrNoReply", what, err, expected)
+		}
+	}
+
+	reply := ""
+	if err := e.CallErr("JunkServer.Handler2", 111, &reply); err != nil || reply != "handler2-111" {
+		t.Fatalf("Handler2 returned %q, %v", reply, err)
+	}
+
+	// misrouted calls fail, rather than kill the process.
+	checkReplied("unknown service", e.CallErr("NoServer.Handler2", 111, &reply), ErrUnknownMethod)
+	checkReplied("unknown method", e.CallErr("JunkServer.NoHandler", 111, &reply), ErrUnknownMethod)
+	checkReplied("no method", e.CallErr("Handler2", 111, &reply), ErrUnknownMethod)
+	var wrong int
+	checkReplied("wrong reply type", e.CallErr("JunkServer.Handler2", 111, &wrong), ErrDecode)
+
+	// dropped, at a rate of about a fifth.
+	rn.Reliable(false)
+	dropped := 0
+	for i := 0; i < 100; i++ {
+		if err := e.CallErr("JunkServer.Handler2", i, &reply); err != nil {
+			check("unreliable call", err, ErrDropped)
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		t.Fatalf("an unreliable network dropped nothing")
+	}
+	rn.Reliable(true)
+
+	rn.Enable("end1-99", false)
+	check("disabled end", e.CallErr("JunkServer.Handler2", 111, &reply), ErrUnreachable)
+	e2 := rn.MakeEnd("end2-99")
+	rn.Enable("end2-99", true)
+	check("unconnected end", e2.CallErr("JunkServer.Handler2", 111, &reply), ErrUnreachable)
+
+	rn.Enable("end1-99", true)
+	rn.DeleteServer("server99")
+	check("deleted server", e.CallErr("JunkServer.Handler2", 111, &reply), ErrServerDead)
+
+	rn.Cleanup()
+	check("cleaned up network", e.CallErr("JunkServer.Handler2", 111, &reply), ErrNetworkClosed)
+}
+
+func TestTCPCallErr(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	_, l := makeTCPServer(t, "127.0.0.1:0")
+	addr := l.Addr()
+	e := MakeTCPEnd(addr, DefaultTCPOptions())
+
+	reply := ""
+	if err := e.CallErr("JunkServer.NoHandler", 111, &reply); !errors.Is(err, ErrUnknownMethod) ||
+		errors.Is(err, ErrNoReply) {
+		t.Fatalf("unknown method returned %v", err)
+	}
+	if err := e.CallErr("JunkServer.Handler2", 111, &reply); err != nil {
+		t.Fatalf("Handler2 returned %v", err)
+	}
+
+	// both pooled connections are stale; the goodbye tells the
+	// calls their requests never ran, and they redial.
+	l.Close()
+	if err := e.CallErr("JunkServer.Handler2", 111, &reply); !errors.Is(err, ErrUnreachable) {
+		t.Fatalf("call to a closed listener returned %v", err)
+	}
+	if err := e.CallErr("JunkServer.Handler2", 111, &reply); !errors.Is(err, ErrUnreachable) {
+		t.Fatalf("call to a closed port returned %v", err)
+	}
+
+	e.Close()
+	if err := e.CallErr("JunkServer.Handler2", 111, &reply); !errors.Is(err, ErrNetworkClosed) {
+		t.Fatalf("call on a closed end returned %v", err)
+	}
+}
+
+func TestGo(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("server99", rs)
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	calls := make([]*Call, 10)
+	for i := range calls {
+		reply := ""
+		calls[i] = e.Go("JunkServer.Handler2", i, &reply)
+	}
+	for i, call := range calls {
+		if <-call.Done != call {
+			t.Fatalf("Done received another call")
+		}
+		expected := "handler2-" + strconv.Itoa(i)
+		if call.Error != nil || *call.Reply.(*string) != expected {
+			t.Fatalf("call %v returned %q, %v; expected %q", i, *call.Reply.(*string), call.Error, expected)
+		}
+	}
+
+	rn.Enable("end1-99", false)
+	reply := ""
+	call := e.Go("JunkServer.Handler2", 111, &reply)
+	if <-call.Done; !errors.Is(call.Error, ErrUnreachable) {
+		t.Fatalf("call on a disabled end returned %v", call.Error)
+	}
+
+	rn.Enable("end1-99", true)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	call = e.GoContext(ctx, "JunkServer.Handler2", 111, &reply)
+	if <-call.Done; call.Error != context.Canceled {
+		t.Fatalf("call with a cancelled context returned %v", call.Error)
+	}
+}
+
+// Echo answers at once, unless slow: then it waits to be cancelled.
+type GatherServer struct {
+	slow      bool
+	cancelled chan bool
+}
+
+func (gs *GatherServer) Echo(ctx context.Context, args int, reply *int) {
+	if gs.slow {
+		select {
+		case <-ctx.Done():
+			gs.cancelled <- true
+		case <-time.After(10 * time.Second):
+			gs.cancelled <- false
+		}
+	}
+	*reply = args
+}
+
+func TestGather(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	// 0-2 answer, 3 is slow, 4 is unreachable.
+	const nservers = 5
+	slow := &GatherServer{slow: true, cancelled: make(chan bool, 10)}
+	ends := make([]*ClientEnd, nservers)
+	for i := range ends {
+		gs := &GatherServer{}
+		if i == 3 {
+			gs = slow
+		}
+		rs := MakeServer()
+		rs.AddService(MakeService(gs))
+		rn.AddServer(i, rs)
+		ends[i] = rn.MakeEnd(fmt.Sprintf("end-%v", i))
+		rn.Connect(fmt.Sprintf("end-%v", i), i)
+		rn.Enable(fmt.Sprintf("end-%v", i), i != 4)
+	}
+	newReply := func() interface{} { return new(int) }
+
+	calls := Gather(context.Background(), ends, "GatherServer.Echo", 7, newReply, 3)
+	if len(calls) != 3 {
+		t.Fatalf("Gather returned %v calls, expected 3", len(calls))
+	}
+	for _, call := range calls {
+		if call.Error != nil || *call.Reply.(*int) != 7 {
+			t.Fatalf("gathered call returned %v, %v", *call.Reply.(*int), call.Error)
+		}
+	}
+
+	// more than can reply: Gather gives up when ctx is done, and
+	// cancels the slow call.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	calls = Gather(ctx, ends, "GatherServer.Echo", 7, newReply, 4)
+	if len(calls) != 3 {
+		t.Fatalf("Gather returned %v calls, expected 3", len(calls))
+	}
+	if time.Since(t0) > 2*time.Second {
+		t.Fatalf("Gather took too long to give up")
+	}
+	select {
+	case c := <-slow.cancelled:
+		if !c {
+			t.Fatalf("straggler was not cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("straggler was not cancelled")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	// every server has an end to every server, and a clerk to each.
+	const nservers = 3
+	name := func(from, to interface{}) string { return fmt.Sprintf("%v-%v", from, to) }
+	for i := 0; i < nservers; i++ {
+		rs := MakeServer()
+		rs.AddService(MakeService(&JunkServer{}))
+		rn.AddServer(i, rs)
+	}
+	ends := map[string]*ClientEnd{}
+	for i := 0; i < nservers; i++ {
+		for _, from := range []interface{}{0, 1, 2, "clerk"} {
+			if from == "clerk" {
+				ends[name(from, i)] = rn.MakeEnd(name(from, i))
+			} else {
+				ends[name(from, i)] = rn.MakeEndFor(name(from, i), from)
+			}
+			rn.Connect(name(from, i), i)
+			rn.Enable(name(from, i), true)
+		}
+	}
+	call := func(from, to interface{}) error {
+		reply := ""
+		return ends[name(from, to)].CallErr("JunkServer.Handler2", 111, &reply)
+	}
+
+	rn.Partition([]interface{}{0, 1}, []interface{}{2})
+	for _, link := range [][2]interface{}{{0, 1}, {1, 0}, {2, 2}, {"clerk", 2}} {
+		if err := call(link[0], link[1]); err != nil {
+			t.Fatalf("%v -> %v failed within a group: %v", link[0], link[1], err)
+		}
+	}
+	for _, link := range [][2]interface{}{{0, 2}, {2, 0}, {1, 2}} {
+		if err := call(link[0], link[1]); !errors.Is(err, ErrUnreachable) {
+			t.Fatalf("%v -> %v across groups returned %v", link[0], link[1], err)
+		}
+	}
+	topo := rn.Topology()
+	if fmt.Sprint(topo[0]) != "[0 1]" || fmt.Sprint(topo[2]) != "[2]" {
+		t.Fatalf("wrong topology %v", topo)
+	}
+	if fmt.Sprint(rn.Groups()) != "[[0 1] [2]]" {
+		t.Fatalf("wrong groups %v", rn.Groups())
+	}
+
+	// Enable() still applies within a group.
+	rn.Enable(name(0, 1), false)
+	if rn.Reachable(0, 1) || !rn.Reachable(1, 0) {
+		t.Fatalf("disabled end is reachable")
+	}
+	rn.Enable(name(0, 1), true)
+
+	// a server in no group reaches nobody.
+	rn.Partition([]interface{}{0, 1})
+	if err := call(2, 2); !errors.Is(err, ErrUnreachable) {
+		t.Fatalf("server in no group reached itself: %v", err)
+	}
+
+	rn.Heal()
+	if rn.Groups() != nil {
+		t.Fatalf("still partitioned after Heal()")
+	}
+	for from := 0; from < nservers; from++ {
+		for to := 0; to < nservers; to++ {
+			if err := call(from, to); err != nil {
+				t.Fatalf("%v -> %v failed after Heal(): %v", from, to, err)
+			}
+		}
+	}
+}
+
+func TestPartitionInFlight(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn, e, cs := makeCtxNetwork()
+	defer rn.Cleanup()
+
+	// a call across a new partition fails, and its handler is cancelled.
+	errCh := make(chan error)
+	go func() {
+		reply := 0
+		errCh <- e.CallErr("CtxServer.Wait", 1, &reply)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	rn.Partition([]interface{}{"client99"}, []interface{}{"server99"})
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrServerDead) {
+			t.Fatalf("call in flight returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("call in flight didn't fail")
+	}
+	if !<-cs.cancelled {
+		t.Fatalf("handler's context was not cancelled")
+	}
+}
+
+func TestLinkFault(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	// two servers, each with an end to the other.
+	servers := []*JunkServer{{}, {}}
+	for i, js := range servers {
+		rs := MakeServer()
+		rs.AddService(MakeService(js))
+		rn.AddServer(i, rs)
+	}
+	ends := make([]*ClientEnd, 2)
+	for i := range ends {
+		name := fmt.Sprintf("%v-%v", i, 1-i)
+		ends[i] = rn.MakeEndFor(name, i)
+		rn.Connect(name, 1-i)
+		rn.Enable(name, true)
+	}
+	// a call from server from, and how many calls its peer has run.
+	call := func(from int) (error, int) {
+		reply := ""
+		err := ends[from].CallErr("JunkServer.Handler2", 111, &reply)
+		js := servers[1-from]
+		js.mu.Lock()
+		defer js.mu.Unlock()
+		return err, len(js.log2)
+	}
+
+	// replies lost: the request still runs.
+	rn.SetLinkFault(0, 1, DropReplies)
+	if err, n := call(0); !errors.Is(err, ErrReplyDropped) || !errors.Is(err, ErrDropped) ||
+		errors.Is(err, ErrRequestDropped) || n != 1 {
+		t.Fatalf("call with its reply dropped returned %v, %v runs", err, n)
+	}
+	if err, _ := call(1); err != nil {
+		t.Fatalf("call the other way returned %v", err)
+	}
+
+	// requests lost: nothing runs.
+	rn.SetLinkFault(0, 1, DropRequests)
+	if err, n := call(0); !errors.Is(err, ErrRequestDropped) || !errors.Is(err, ErrDropped) ||
+		errors.Is(err, ErrReplyDropped) || n != 1 {
+		t.Fatalf("call with its request dropped returned %v, %v runs", err, n)
+	}
+	rn.SetLinkFault(0, 1, LinkOK)
+	if err, _ := call(0); err != nil {
+		t.Fatalf("call on a repaired link returned %v", err)
+	}
+
+	// nothing from 0 gets to 1: 1 runs nothing of 0's, and 0's
+	// replies to 1 are lost, though 0 runs 1's calls.
+	rn.CutOneWay(0, 1)
+	if rn.GetLinkFault(0, 1) != DropRequests || rn.GetLinkFault(1, 0) != DropReplies {
+		t.Fatalf("CutOneWay set %v and %v", rn.GetLinkFault(0, 1), rn.GetLinkFault(1, 0))
+	}
+	if err, n := call(0); !errors.Is(err, ErrDropped) || n != 2 {
+		t.Fatalf("call over a cut link returned %v, %v runs", err, n)
+	}
+	if err, n := call(1); !errors.Is(err, ErrDropped) || n != 2 {
+		t.Fatalf("call back over a cut link returned %v, %v runs", err, n)
+	}
+	if rn.Reachable(0, 1) || rn.Reachable(1, 0) {
+		t.Fatalf("cut link is reachable, topology %v", rn.Topology())
+	}
+
+	// RestoreOneWay() undoes the cut in both directions, and only
+	// the cut.
+	rn.SetLinkFault(1, 0, rn.GetLinkFault(1, 0)|DropRequests)
+	rn.RestoreOneWay(0, 1)
+	if rn.GetLinkFault(0, 1) != LinkOK || rn.GetLinkFault(1, 0) != DropRequests {
+		t.Fatalf("RestoreOneWay left %v and %v", rn.GetLinkFault(0, 1), rn.GetLinkFault(1, 0))
+	}
+	if err, _ := call(0); err != nil {
+		t.Fatalf("call over a restored link returned %v", err)
+	}
+	rn.CutOneWay(0, 1)
+
+	rn.Heal()
+	if err, _ := call(0); err != nil {
+		t.Fatalf("call after Heal() returned %v", err)
+	}
+	if err, _ := call(1); err != nil {
+		t.Fatalf("call back after Heal() returned %v", err)
+	}
+}
+
+func TestFaultProfile(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+	ends := make([]*ClientEnd, 2)
+	for i := range ends {
+		name := fmt.Sprintf("end%v-99", i)
+		ends[i] = rn.MakeEnd(name)
+		rn.Connect(name, "server99")
+		rn.Enable(name, true)
+	}
+	call := func(e *ClientEnd, svcMeth string) (error, time.Duration) {
+		t0 := time.Now()
+		if svcMeth == "JunkServer.Handler1" {
+			reply := 0
+			return e.CallErr(svcMeth, "111", &reply), time.Since(t0)
+		}
+		reply := ""
+		return e.CallErr(svcMeth, 111, &reply), time.Since(t0)
+	}
+	runs := func() int {
+		js.mu.Lock()
+		defer js.mu.Unlock()
+		return len(js.log2)
+	}
+
+	// per method: every Handler2 request is lost, Handler1 is fine.
+	rn.SetFaultProfile(nil, "JunkServer.Handler2", &FaultProfile{DropRequests: 1})
+	if err, _ := call(ends[0], "JunkServer.Handler2"); !errors.Is(err, ErrRequestDropped) || runs() != 0 {
+		t.Fatalf("dropped request returned %v, %v runs", err, runs())
+	}
+	if err, _ := call(ends[0], "JunkServer.Handler1"); err != nil {
+		t.Fatalf("other method returned %v", err)
+	}
+
+	// per link, which beats per method: replies lost, after the run.
+	rn.SetFaultProfile("end0-99", "", &FaultProfile{DropReplies: 1})
+	if err, _ := call(ends[0], "JunkServer.Handler2"); !errors.Is(err, ErrReplyDropped) || runs() != 1 {
+		t.Fatalf("dropped reply returned %v, %v runs", err, runs())
+	}
+	rn.SetFaultProfile(nil, "JunkServer.Handler2", nil)
+	if err, _ := call(ends[1], "JunkServer.Handler2"); err != nil || runs() != 2 {
+		t.Fatalf("cleared profile returned %v, %v runs", err, runs())
+	}
+
+	// latency, on one link only.
+	rn.SetFaultProfile("end0-99", "", &FaultProfile{Latency: Constant(100 * time.Millisecond)})
+	if err, d := call(ends[0], "JunkServer.Handler2"); err != nil || d < 100*time.Millisecond {
+		t.Fatalf("slow link returned %v after %v", err, d)
+	}
+	if err, d := call(ends[1], "JunkServer.Handler2"); err != nil || d > 50*time.Millisecond {
+		t.Fatalf("fast link returned %v after %v", err, d)
+	}
+
+	// reordering holds replies back.
+	rn.SetFaultProfile("end0-99", "", &FaultProfile{Reorder: 1, ReorderDelay: Constant(100 * time.Millisecond)})
+	if err, d := call(ends[0], "JunkServer.Handler2"); err != nil || d < 100*time.Millisecond {
+		t.Fatalf("reordered call returned %v after %v", err, d)
+	}
+
+	// duplicates run the handler twice.
+	rn.SetFaultProfile("end0-99", "", &FaultProfile{Duplicate: 1})
+	before := runs()
+	if err, _ := call(ends[0], "JunkServer.Handler2"); err != nil {
+		t.Fatalf("duplicated call returned %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if runs() != before+2 {
+		t.Fatalf("duplicated call ran %v times", runs()-before)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	const n = 10000
+	mean := func(l Latency, check func(d time.Duration) bool) time.Duration {
+		var sum time.Duration
+		for i := 0; i < n; i++ {
+			d := l.Sample(r)
+			if !check(d) {
+				t.Fatalf("%v sampled %v", l, d)
+			}
+			sum += d
+		}
+		return sum / n
+	}
+	ms := time.Millisecond
+
+	if m := mean(Constant(5*ms), func(d time.Duration) bool { return d == 5*ms }); m != 5*ms {
+		t.Fatalf("Constant mean %v", m)
+	}
+	m := mean(Uniform(10*ms, 20*ms), func(d time.Duration) bool { return d >= 10*ms && d < 20*ms })
+	if m < 14*ms || m > 16*ms {
+		t.Fatalf("Uniform mean %v", m)
+	}
+	m = mean(Normal(50*ms, 10*ms), func(d time.Duration) bool { return d >= 0 })
+	if m < 48*ms || m > 52*ms {
+		t.Fatalf("Normal mean %v", m)
+	}
+	// Pareto with alpha 3 has mean min*alpha/(alpha-1)
+	m = mean(LongTail(10*ms, 3), func(d time.Duration) bool { return d >= 10*ms })
+	if m < 14*ms || m > 16*ms {
+		t.Fatalf("LongTail mean %v", m)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	// which of a run of calls an unreliable network drops.
+	drops := func(rn *Network) string {
+		defer rn.Cleanup()
+		rs := MakeServer()
+		rs.AddService(MakeService(&JunkServer{}))
+		rn.AddServer("server99", rs)
+		e := rn.MakeEnd("end1-99")
+		rn.Connect("end1-99", "server99")
+		rn.Enable("end1-99", true)
+		rn.Reliable(false)
+
+		pattern := ""
+		for i := 0; i < 100; i++ {
+			reply := ""
+			if e.CallErr("JunkServer.Handler2", i, &reply) == nil {
+				pattern += "."
+			} else {
+				pattern += "x"
+			}
+		}
+		return pattern
+	}
+
+	rn := MakeNetworkSeed(42)
+	if rn.Seed() != 42 {
+		t.Fatalf("Seed() is %v, expected 42", rn.Seed())
+	}
+	first := drops(rn)
+	if again := drops(MakeNetworkSeed(42)); again != first {
+		t.Fatalf("the same seed dropped differently:\n%v\n%v", first, again)
+	}
+
+	t.Setenv(SeedEnv, "42")
+	if env := drops(MakeNetwork()); env != first {
+		t.Fatalf("%v=42 dropped differently:\n%v\n%v", SeedEnv, first, env)
+	}
+}
+
+func TestSetClock(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+	sim := labclock.NewSim()
+	sim.AutoAdvance(time.Millisecond)
+	defer sim.Stop()
+	rn.SetClock(sim)
+
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("server99", rs)
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+	rn.SetFaultProfile(nil, "", &FaultProfile{Latency: Constant(10 * time.Second)})
+
+	t0 := time.Now()
+	start := sim.Now()
+	reply := ""
+	if err := e.CallErr("JunkServer.Handler2", 111, &reply); err != nil || reply != "handler2-111" {
+		t.Fatalf("wrong reply %v from Handler2, err %v", reply, err)
+	}
+	if d := sim.Since(start); d < 10*time.Second {
+		t.Fatalf("call took %v of simulated time, expected at least 10s", d)
+	}
+	if d := time.Since(t0); d > 2*time.Second {
+		t.Fatalf("call took %v of real time", d)
+	}
+}
@@ -9,18 +9,20 @@ package raft
 //
 
 import (
+	"bytes"
 	"log"
 	"math/rand"
 	"runtime"
 	"sync"
 	"testing"
 
+	"6.824-lab/labclock"
+	"6.824-lab/labgob"
 	"6.824-lab/labrpc"
 
 	crand "crypto/rand"
 	"encoding/base64"
 	"fmt"
-	"math/big"
 	"time"
 )
 
@@ -31,18 +33,45 @@ func randstring(n int) string {
 	return s[0:n]
 }
 
-func makeSeed() int64 {
-	max := big.NewInt(int64(1) << 62)
-	bigx, _ := crand.Int(crand.Reader, max)
-	x := bigx.Int64()
-	return x
+// set by test_test.go's -seed flag; zero leaves the seed to
+// labrpc.MakeNetwork().
+var netSeed int64
+
+// set by test_test.go's -simtime flag: every Raft, the network and
+// the tester itself run in simulated time, which jumps ahead
+// whenever all of them wait for it, see labclock.
+var simTime bool
+
+// on runtimes that can't tell when everyone is blocked, how long
+// nobody may touch a timer before simulated time jumps.
+const simQuiet = time.Millisecond
+
+// a rand.Source that a test's goroutines can share.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
 }
 
 type config struct {
 	mu        sync.Mutex
-	t         *testing.T
+	t         testing.TB
 	net       *labrpc.Network
+	clock     labclock.Clock // the tester's and every Raft's, see simTime
 	n         int
+	rand      *rand.Rand // the test's own random choices, see make_config()
+	opts      Options    // handed to every Raft created by start1()
 	rafts     []*Raft
 	applyErr  []string // from apply channel readers
 	connected []bool   // whether each server is on the net
@@ -57,21 +86,50 @@ type config struct {
 	bytes0    int64
 	maxIndex  int
 	maxIndex0 int
+
+	checkDurable bool                      // fail if an entry is applied before a majority persisted it
+	onApply      func(i int, m ApplyMsg)   // if set, sees every ApplyMsg of every server
+	onBatch      func(i int, b ApplyBatch) // if set, sees every batch when batchApply
+	batchApply   bool                      // start1() uses MakeBatched()
 }
 
 var ncpu_once sync.Once
 
-func make_config(t *testing.T, n int, unreliable bool) *config {
+func make_config(t testing.TB, n int, unreliable bool) *config {
+	return make_config_options(t, n, unreliable, DefaultOptions())
+}
+
+func make_config_options(t testing.TB, n int, unreliable bool, opts Options) *config {
 	ncpu_once.Do(func() {
 		if runtime.NumCPU() < 2 {
 			fmt.Printf("warning: only one CPU, which may conceal locking bugs\n")
 		}
-		rand.Seed(makeSeed())
 	})
 	runtime.GOMAXPROCS(4)
 	cfg := &config{}
 	cfg.t = t
-	cfg.net = labrpc.MakeNetwork()
+	cfg.opts = opts
+	if netSeed != 0 {
+		cfg.net = labrpc.MakeNetworkSeed(netSeed)
+	} else {
+		cfg.net = labrpc.MakeNetwork()
+	}
+	// the test's own random choices, and the Rafts' election
+	// timeouts, replay along with the network's
+	cfg.rand = rand.New(&lockedSource{src: rand.NewSource(cfg.net.Seed())})
+	if cfg.opts.Seed == 0 {
+		cfg.opts.Seed = cfg.net.Seed()
+	}
+	t.Logf("labrpc seed %v; replay with -seed=%v or %v=%v",
+		cfg.net.Seed(), cfg.net.Seed(), labrpc.SeedEnv, cfg.net.Seed())
+	cfg.clock = labclock.Real
+	if simTime {
+		sim := labclock.NewSim()
+		sim.AutoAdvance(simQuiet)
+		cfg.clock = sim
+		cfg.net.SetClock(sim)
+		cfg.opts.Clock = sim
+	}
 	cfg.n = n
 	cfg.applyErr = make([]string, cfg.n)
 	cfg.rafts = make([]*Raft, cfg.n)
@@ -124,9 +182,12 @@ func (cfg *config) crash1(i int) {
 	}
 
 	if cfg.saved[i] != nil {
-		raftlog := cfg.saved[i].ReadRaftState()
-		cfg.saved[i] = &Persister{}
-		cfg.saved[i].SaveRaftState(raftlog)
+		hardstate := cfg.saved[i].ReadHardState()
+		raftlog := cfg.saved[i].ReadLogEntries()
+		cfg.saved[i] = MakePersister()
+		cfg.saved[i].SetClock(cfg.clock)
+		cfg.saved[i].SaveHardState(hardstate)
+		cfg.saved[i].SaveLogEntries(0, raftlog)
 	}
 }
 
@@ -150,7 +211,7 @@ func (cfg *config) start1(i int) {
 	// a fresh set of ClientEnds.
 	ends := make([]*labrpc.ClientEnd, cfg.n)
 	for j := 0; j < cfg.n; j++ {
-		ends[j] = cfg.net.MakeEnd(cfg.endnames[i][j])
+		ends[j] = cfg.net.MakeEndFor(cfg.endnames[i][j], i)
 		cfg.net.Connect(cfg.endnames[i][j], j)
 	}
 
@@ -164,6 +225,7 @@ func (cfg *config) start1(i int) {
 		cfg.saved[i] = cfg.saved[i].Copy()
 	} else {
 		cfg.saved[i] = MakePersister()
+		cfg.saved[i].SetClock(cfg.clock)
 	}
 
 	cfg.mu.Unlock()
@@ -185,6 +247,12 @@ func (cfg *config) start1(i int) {
 							m.CommandIndex, i, m.Command, j, old)
 					}
 				}
+				if cfg.checkDurable {
+					if nd := cfg.nDurable(m.CommandIndex, v); nd <= cfg.n/2 {
+						err_msg = fmt.Sprintf("server %v applied index %v stored by only %v servers",
+							i, m.CommandIndex, nd)
+					}
+				}
 				_, prevok := cfg.logs[i][m.CommandIndex-1]
 				cfg.logs[i][m.CommandIndex] = v
 				if m.CommandIndex > cfg.maxIndex {
@@ -197,6 +265,13 @@ func (cfg *config) start1(i int) {
 				}
 			}
 
+			cfg.mu.Lock()
+			onApply := cfg.onApply
+			cfg.mu.Unlock()
+			if onApply != nil {
+				onApply(i, m)
+			}
+
 			if err_msg != "" {
 				log.Fatalf("apply error: %v\n", err_msg)
 				cfg.applyErr[i] = err_msg
@@ -206,7 +281,30 @@ func (cfg *config) start1(i int) {
 		}
 	}()
 
-	rf := Make(ends, i, cfg.saved[i], applyCh)
+	var rf *Raft
+	if cfg.batchApply {
+		// unpack batches for the reader above
+		batchCh := make(chan ApplyBatch)
+		go func() {
+			for b := range batchCh {
+				if len(b.Entries) == 0 {
+					log.Fatalf("apply error: server %v sent an empty batch\n", i)
+				}
+				cfg.mu.Lock()
+				onBatch := cfg.onBatch
+				cfg.mu.Unlock()
+				if onBatch != nil {
+					onBatch(i, b)
+				}
+				for _, m := range b.Entries {
+					applyCh <- m
+				}
+			}
+		}()
+		rf = MakeBatched(ends, i, cfg.saved[i], batchCh, cfg.opts)
+	} else {
+		rf = MakeWithOptions(ends, i, cfg.saved[i], applyCh, cfg.opts)
+	}
 
 	cfg.mu.Lock()
 	cfg.rafts[i] = rf
@@ -218,6 +316,27 @@ func (cfg *config) start1(i int) {
 	cfg.net.AddServer(i, srv)
 }
 
+// how many servers have durably stored cmd at index?
+// should be called when holding cfg.mu
+func (cfg *config) nDurable(index int, cmd interface{}) int {
+	count := 0
+	for j := 0; j < cfg.n; j++ {
+		if cfg.saved[j] == nil {
+			continue
+		}
+		entries := cfg.saved[j].ReadLogEntries()
+		if len(entries) < index {
+			continue
+		}
+		var entry LogEntry
+		d := labgob.NewDecoder(bytes.NewBuffer(entries[index-1]))
+		if d.Decode(&entry) == nil && decodeCommand(entry.Data) == cmd {
+			count += 1
+		}
+	}
+	return count
+}
+
 func (cfg *config) checkTimeout() {
 	// enforce a two minute real-time limit on each test
 	if !cfg.t.Failed() && time.Since(cfg.start) > 120*time.Second {
@@ -232,6 +351,9 @@ func (cfg *config) cleanup() {
 		}
 	}
 	cfg.net.Cleanup()
+	if sim, ok := cfg.clock.(*labclock.Sim); ok {
+		sim.Stop()
+	}
 	cfg.checkTimeout()
 }
 
@@ -281,6 +403,24 @@ func (cfg *config) disconnect(i int) {
 	}
 }
 
+// split the connected servers into groups that only reach each
+// other, e.g. cfg.partition([]int{0, 1}, []int{2, 3, 4}).
+// connect() and disconnect() still apply on top.
+func (cfg *config) partition(groups ...[]int) {
+	xgroups := make([][]interface{}, len(groups))
+	for g, servers := range groups {
+		for _, i := range servers {
+			xgroups[g] = append(xgroups[g], i)
+		}
+	}
+	cfg.net.Partition(xgroups...)
+}
+
+// undo partition().
+func (cfg *config) heal() {
+	cfg.net.Heal()
+}
+
 func (cfg *config) rpcCount(server int) int {
 	return cfg.net.GetCount(server)
 }
@@ -305,8 +445,8 @@ func (cfg *config) setlongreordering(longrel bool) {
 // try a few times in case re-elections are needed.
 func (cfg *config) checkOneLeader() int {
 	for iters := 0; iters < 10; iters++ {
-		ms := 450 + (rand.Int63() % 100)
-		time.Sleep(time.Duration(ms) * time.Millisecond)
+		ms := 450 + (cfg.rand.Int63() % 100)
+		cfg.clock.Sleep(time.Duration(ms) * time.Millisecond)
 
 		leaders := make(map[int][]int)
 		for i := 0; i < cfg.n; i++ {
@@ -397,7 +537,7 @@ func (cfg *config) wait(index int, n int, startTerm int) interface{} {
 		if nd >= n {
 			break
 		}
-		time.Sleep(to)
+		cfg.clock.Sleep(to)
 		if to < time.Second {
 			to *= 2
 		}
@@ -432,9 +572,9 @@ func (cfg *config) wait(index int, n int, startTerm int) interface{} {
 // if retry==false, calls Start() only once, in order
 // to simplify the early Lab 2B tests.
 func (cfg *config) one(cmd interface{}, expectedServers int, retry bool) int {
-	t0 := time.Now()
+	t0 := cfg.clock.Now()
 	starts := 0
-	for time.Since(t0).Seconds() < 10 {
+	for cfg.clock.Since(t0).Seconds() < 10 {
 		// try all the servers, maybe one is the leader.
 		index := -1
 		for si := 0; si < cfg.n; si++ {
@@ -457,8 +597,8 @@ func (cfg *config) one(cmd interface{}, expectedServers int, retry bool) int {
 		if index != -1 {
 			// somebody claimed to be the leader and to have
 			// submitted our command; wait a while for agreement.
-			t1 := time.Now()
-			for time.Since(t1).Seconds() < 2 {
+			t1 := cfg.clock.Now()
+			for cfg.clock.Since(t1).Seconds() < 2 {
 				nd, cmd1 := cfg.nCommitted(index)
 				if nd > 0 && nd >= expectedServers {
 					// committed
@@ -467,13 +607,13 @@ func (cfg *config) one(cmd interface{}, expectedServers int, retry bool) int {
 						return index
 					}
 				}
-				time.Sleep(20 * time.Millisecond)
+				cfg.clock.Sleep(20 * time.Millisecond)
 			}
 			if retry == false {
 				cfg.t.Fatalf("one(%v) failed to reach agreement", cmd)
 			}
 		} else {
-			time.Sleep(50 * time.Millisecond)
+			cfg.clock.Sleep(50 * time.Millisecond)
 		}
 	}
 	cfg.t.Fatalf("one(%v) failed to reach agreement", cmd)
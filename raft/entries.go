@@ -0,0 +1,90 @@
+package raft
+
+//
+// read-only access to the committed log, for tools that compare
+// replicas while they run.
+//
+// rf.Entries(lo, hi, maxBytes) ([]LogEntry, error)
+//   committed entries in [lo, hi), with their terms.
+// rf.LogDigest(upTo) (uint64, error)
+//   a rolling hash of the committed entries 1..upTo; two peers
+//   with the same digest at an index hold the same prefix.
+//
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+)
+
+// the index asked for is not committed on this peer yet.
+var ErrUncommitted = errors.New("raft: index not committed")
+
+//
+// return the committed entries in [lo, hi), stopping early once
+// their payloads add up to more than maxBytes (zero means no limit).
+// the first entry is returned whatever its size. hi is cut down to
+// this peer's commit index. the entries are copies, payloads too.
+//
+func (rf *Raft) Entries(lo, hi int, maxBytes int) ([]LogEntry, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	// Logs[0] is a placeholder, the first entry kept is at index 1
+	if lo < 1 {
+		return nil, ErrCompacted
+	}
+	hi = min(hi, rf.commitIndex+1)
+	if lo >= hi {
+		return nil, nil
+	}
+
+	size := 0
+	entries := make([]LogEntry, 0, hi-lo)
+	for _, entry := range rf.Logs[lo:hi] {
+		size += len(entry.Data)
+		if maxBytes > 0 && size > maxBytes && len(entries) > 0 {
+			break
+		}
+		// the caller mustn't be able to change the log through Data
+		entry.Data = append([]byte(nil), entry.Data...)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+//
+// return the digest of the committed prefix up to index upTo.
+// LogDigest(0) is the digest of the empty log.
+//
+func (rf *Raft) LogDigest(upTo int) (uint64, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if upTo > rf.commitIndex {
+		return 0, ErrUncommitted
+	}
+	if upTo < 0 {
+		return 0, ErrCompacted
+	}
+	// committed entries never change, so digests are computed
+	// once and kept; digests[i] covers entries 1..i.
+	if len(rf.digests) == 0 {
+		rf.digests = append(rf.digests, fnv.New64a().Sum64())
+	}
+	for i := len(rf.digests); i <= upTo; i++ {
+		rf.digests = append(rf.digests, digestEntry(rf.digests[i-1], rf.Logs[i]))
+	}
+	return rf.digests[upTo], nil
+}
+
+func digestEntry(prev uint64, entry LogEntry) uint64 {
+	var buf [24]byte
+	binary.BigEndian.PutUint64(buf[0:], prev)
+	binary.BigEndian.PutUint64(buf[8:], uint64(entry.Term))
+	binary.BigEndian.PutUint64(buf[16:], uint64(entry.Type))
+	h := fnv.New64a()
+	h.Write(buf[:])
+	h.Write(entry.Data)
+	return h.Sum64()
+}
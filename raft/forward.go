@@ -0,0 +1,180 @@
+package raft
+
+//
+// proposal forwarding. with Options.ForwardProposals, Start() and
+// Propose() on a follower send the entry to the leader it last heard
+// from over the Raft.Forward RPC, and return the index and term the
+// leader assigned.
+//
+// each forwarded proposal carries (Client, Seq), Client drawn afresh
+// each time the follower starts, since Seq starts over; a leader
+// remembers the ones it appended, so a retried RPC doesn't append
+// twice. like Start(), there is no guarantee across a change of
+// leader. only commands, as from Start() and Propose(), may be
+// forwarded.
+//
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+)
+
+// how many times a follower sends one proposal to the same leader.
+const forwardTries = 3
+
+type ForwardArgs struct {
+	Term   int       // follower's term
+	From   int       // follower forwarding the proposal
+	Client int64     // this incarnation of From, see newForwardClient()
+	Seq    int64     // per Client, identifies the proposal
+	Done   int64     // every Seq up to this one got its reply
+	Type   EntryType // EntryCommand or EntryNormal, and the payload
+	Data   []byte
+}
+
+type ForwardReply struct {
+	WrongLeader bool // not the leader, not in the follower's term, or not a command
+	Dropped     bool // turned down for backpressure
+	Index       int  // where the leader appended it
+	Term        int
+}
+
+type forwarded struct {
+	index int
+	term  int
+}
+
+// a random id, so that a leader can't take a restarted follower's
+// proposals for ones from before the restart.
+func newForwardClient() int64 {
+	b := make([]byte, 8)
+	crand.Read(b)
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+// propose(), or forward to the leader if this peer is a follower
+// and Options.ForwardProposals is set.
+func (rf *Raft) proposeOrForward(typ EntryType, data []byte) (int, int, error) {
+	index, term, err := rf.propose(typ, data)
+	if err == ErrNotLeader && rf.opts.ForwardProposals && !rf.killed() {
+		return rf.forward(typ, data)
+	}
+	return index, term, err
+}
+
+func (rf *Raft) forward(typ EntryType, data []byte) (int, int, error) {
+	rf.mu.Lock()
+	leader, term := rf.leader, rf.CurrentTerm
+	if leader == -1 || leader == rf.me {
+		rf.mu.Unlock()
+		return -1, 0, ErrNotLeader
+	}
+	rf.forwardSeq++
+	// waiting from now on, or Done would take in this Seq
+	rf.forwarding[rf.forwardSeq] = true
+	args := ForwardArgs{
+		Term:   term,
+		From:   rf.me,
+		Client: rf.forwardClient,
+		Seq:    rf.forwardSeq,
+		Done:   rf.forwardDone(),
+		Type:   typ,
+		Data:   data,
+	}
+	rf.mu.Unlock()
+
+	defer func() {
+		rf.mu.Lock()
+		delete(rf.forwarding, args.Seq)
+		rf.mu.Unlock()
+	}()
+
+	for i := 0; i < forwardTries; i++ {
+		var reply ForwardReply
+		if rf.peers[leader].Forward(&args, &reply) {
+			if reply.WrongLeader {
+				return -1, 0, ErrNotLeader
+			}
+			if reply.Dropped {
+				return -1, 0, ErrProposalDropped
+			}
+			rf.mu.Lock()
+			rf.metrics.ProposalsForwarded++
+			rf.mu.Unlock()
+			DPrintf("[%d-%s]: forwarded entry to leader %d, index %d\n", rf.me, rf, leader, reply.Index)
+			return reply.Index, reply.Term, nil
+		}
+
+		// give up once the leader it was sent to is gone
+		rf.mu.Lock()
+		same := rf.leader == leader && rf.CurrentTerm == term
+		rf.mu.Unlock()
+		if !same {
+			break
+		}
+		rf.clock.Sleep(rf.heartbeatInterval)
+	}
+	return -1, 0, ErrNotLeader
+}
+
+// every Seq up to the returned one has had its reply.
+// should be called when holding the lock
+func (rf *Raft) forwardDone() int64 {
+	done := rf.forwardSeq
+	for seq := range rf.forwarding {
+		if seq <= done {
+			done = seq - 1
+		}
+	}
+	return done
+}
+
+// Forward RPC handler, a follower's proposal for the leader
+func (rf *Raft) Forward(args *ForwardArgs, reply *ForwardReply) {
+	select {
+	case <-rf.shutdownCh:
+		reply.WrongLeader = true
+		return
+	default:
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.state != Leader || args.Term != rf.CurrentTerm {
+		reply.WrongLeader = true
+		return
+	}
+	if args.Type != EntryCommand && args.Type != EntryNormal {
+		// no-ops and configuration changes are the leader's own
+		reply.WrongLeader = true
+		return
+	}
+
+	seen := rf.forwarded[args.Client]
+	if seen == nil {
+		seen = make(map[int64]forwarded)
+		rf.forwarded[args.Client] = seen
+	}
+	for seq := range seen {
+		if seq <= args.Done {
+			delete(seen, seq)
+		}
+	}
+	if f, ok := seen[args.Seq]; ok {
+		// a retry, it's in the log already
+		reply.Index, reply.Term = f.index, f.term
+		return
+	}
+
+	if !rf.admitProposal(len(args.Data)) {
+		rf.metrics.ProposalsDropped++
+		reply.Dropped = true
+		return
+	}
+	index := rf.appendEntry(args.Type, args.Data)
+	rf.metrics.ProposalsAccepted++
+	seen[args.Seq] = forwarded{index: index, term: rf.CurrentTerm}
+	reply.Index, reply.Term = index, rf.CurrentTerm
+	DPrintf("[%d-%s]: entry (%d) forwarded by peer %d\n", rf.me, rf, index, args.From)
+}
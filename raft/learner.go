@@ -0,0 +1,116 @@
+package raft
+
+//
+// learners: peers that receive the log but neither vote nor count
+// toward the commit quorum, e.g. read replicas and warm standbys.
+//
+// Options.Learners lists the peers that start out as learners, and
+// must be the same on every peer. the leader promotes one to voter
+// with an EntryConfChange entry, which, as in the Raft thesis (4.1),
+// takes effect on every peer as soon as it is in its log.
+//
+// rf.Promote(peer) (index, term, err)
+//   leader only; fails with ErrLearnerBehind unless the learner's
+//   matchIndex is within Options.PromoteLag of the last log index.
+//
+
+import (
+	"bytes"
+	"errors"
+
+	"6.824-lab/labgob"
+)
+
+var ErrNotLearner = errors.New("raft: peer is not a learner")
+
+// the learner has too much of the log left to catch up on.
+var ErrLearnerBehind = errors.New("raft: learner is behind")
+
+// only one configuration change may be uncommitted at a time.
+var ErrConfChangePending = errors.New("raft: configuration change pending")
+
+// payload of an EntryConfChange: Peer becomes a voter.
+type ConfChange struct {
+	Peer int
+}
+
+func (rf *Raft) Promote(peer int) (int, int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.state != Leader {
+		return -1, 0, ErrNotLeader
+	}
+	if peer < 0 || peer >= len(rf.peers) || !rf.learner[peer] {
+		return -1, 0, ErrNotLearner
+	}
+	if rf.confIndex > rf.commitIndex {
+		return -1, 0, ErrConfChangePending
+	}
+	if rf.matchIndex[peer] < len(rf.Logs)-1-rf.opts.PromoteLag {
+		return -1, 0, ErrLearnerBehind
+	}
+
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(ConfChange{Peer: peer})
+	index := rf.appendEntry(EntryConfChange, w.Bytes())
+	DPrintf("[%d-%s]: leader %d promotes learner %d at index %d\n", rf.me, rf, rf.me, peer, index)
+	return index, rf.CurrentTerm, nil
+}
+
+// should be called when holding the lock, after the log changed
+// from index from on. brings learner[] and this peer's role in line
+// with the configuration changes in the log.
+func (rf *Raft) updateConfig(from int) {
+	if from <= rf.confIndex {
+		// a change was truncated away, start over
+		for i := range rf.learner {
+			rf.learner[i] = false
+		}
+		for _, n := range rf.opts.Learners {
+			rf.learner[n] = true
+		}
+		rf.confIndex = 0
+		from = 1
+	}
+	for i := from; i < len(rf.Logs); i++ {
+		if rf.Logs[i].Type != EntryConfChange {
+			continue
+		}
+		var cc ConfChange
+		d := labgob.NewDecoder(bytes.NewBuffer(rf.Logs[i].Data))
+		if d.Decode(&cc) != nil {
+			DPrintf("[%d-%s]: failed to decode conf change %d\n", rf.me, rf, i)
+			continue
+		}
+		rf.learner[cc.Peer] = false
+		rf.confIndex = i
+	}
+
+	if rf.state == Follower || rf.state == Learner {
+		rf.state = rf.followerState()
+	}
+	rf.noteChanges()
+}
+
+// Follower, or Learner if this peer doesn't vote.
+// should be called when holding the lock
+func (rf *Raft) followerState() int {
+	if rf.learner[rf.me] {
+		return Learner
+	}
+	return Follower
+}
+
+// the peers that vote, this one included if it does.
+// should be called when holding the lock
+func (rf *Raft) voters() []int {
+	var voters []int
+	for i := range rf.peers {
+		if !rf.learner[i] {
+			voters = append(voters, i)
+		}
+	}
+	return voters
+}
@@ -0,0 +1,26 @@
+package raft
+
+//
+// counters a service can poll to see how its Raft peer is doing.
+//
+
+type Metrics struct {
+	ProposalsAccepted int64
+	// proposals this follower forwarded that the leader accepted.
+	ProposalsForwarded int64
+	// proposals rejected with ErrProposalDropped, broken down by
+	// the limit in Options that was exceeded, or the handoff under
+	// way, see Options.HandOffLag.
+	ProposalsDropped          int64
+	DroppedUncommittedEntries int64
+	DroppedUncommittedBytes   int64
+	DroppedUnappliedEntries   int64
+	DroppedHandOff            int64
+}
+
+// a copy of this peer's counters.
+func (rf *Raft) Metrics() Metrics {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.metrics
+}
@@ -0,0 +1,175 @@
+package raft
+
+//
+// watching a peer's role, term, leader and connectivity, instead of
+// polling GetState().
+//
+// ch, cancel := rf.Observe()
+//   ch receives an Event for every change from now on, in order.
+//   every observer has its own queue, so a slow one never holds up
+//   Raft or the other observers. cancel() closes ch.
+//
+// the queue is bounded: a new EventPeer replaces one for the same
+// peer still queued, and once maxObserverQueue events are queued any
+// new event replaces the oldest of its kind. an observer that falls
+// behind misses changes in between, but every event carries the
+// latest view, so it still ends up seeing where things stand.
+//
+
+import "sync"
+
+// events queued per observer before older ones are replaced.
+const maxObserverQueue = 64
+
+type EventKind int
+
+const (
+	EventState  EventKind = iota // became Follower, Candidate or Leader
+	EventTerm                    // moved to a new term
+	EventLeader                  // learned of a leader, or lost track of it
+	EventPeer                    // a peer became reachable or unreachable
+)
+
+// what changed, and this peer's view right after the change.
+type Event struct {
+	Kind   EventKind
+	Term   int
+	State  int // Follower, Candidate or Leader
+	Leader int // -1 if not known
+	// EventPeer only: the peer, and whether its last RPC got through.
+	Peer      int
+	Reachable bool
+}
+
+type observer struct {
+	queue []Event
+	cond  *sync.Cond // on rf.mu, for new events or cancel
+	done  bool
+}
+
+func (rf *Raft) Observe() (<-chan Event, func()) {
+	ch := make(chan Event)
+	ob := &observer{cond: sync.NewCond(&rf.mu)}
+
+	rf.mu.Lock()
+	rf.observers = append(rf.observers, ob)
+	rf.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			rf.mu.Lock()
+			defer rf.mu.Unlock()
+			for i := range rf.observers {
+				if rf.observers[i] == ob {
+					rf.observers = append(rf.observers[:i], rf.observers[i+1:]...)
+					break
+				}
+			}
+			ob.done = true
+			ob.cond.Broadcast()
+		})
+	}
+	go rf.observerDaemon(ob, ch)
+	return ch, cancel
+}
+
+// observerDaemon delivers one observer's events, exits when it's
+// cancelled or the shutdown channel is closed
+func (rf *Raft) observerDaemon(ob *observer, ch chan Event) {
+	defer close(ch)
+	for {
+		rf.mu.Lock()
+		for len(ob.queue) == 0 && !ob.done {
+			ob.cond.Wait()
+		}
+		if ob.done {
+			rf.mu.Unlock()
+			return
+		}
+		events := ob.queue
+		ob.queue = nil
+		rf.mu.Unlock()
+
+		for _, ev := range events {
+			select {
+			case ch <- ev:
+			case <-rf.shutdownCh:
+				return
+			}
+			rf.mu.Lock()
+			done := ob.done
+			rf.mu.Unlock()
+			if done {
+				return
+			}
+		}
+	}
+}
+
+// should be called when holding the lock, after state, CurrentTerm
+// or leader may have changed. emits an event for each that did.
+func (rf *Raft) noteChanges() {
+	// compare field by field, every event carries the latest view
+	if rf.CurrentTerm != rf.observed.Term {
+		rf.observed.Term = rf.CurrentTerm
+		rf.emit(EventTerm)
+	}
+	if rf.state != rf.observed.State {
+		rf.observed.State = rf.state
+		rf.emit(EventState)
+	}
+	if rf.leader != rf.observed.Leader {
+		rf.observed.Leader = rf.leader
+		rf.emit(EventLeader)
+	}
+}
+
+// should be called when holding the lock
+func (rf *Raft) emit(kind EventKind) {
+	rf.broadcast(Event{
+		Kind:   kind,
+		Term:   rf.CurrentTerm,
+		State:  rf.state,
+		Leader: rf.leader,
+	})
+}
+
+// should be called when holding the lock, after an RPC to peer n
+// got a reply (ok) or didn't.
+func (rf *Raft) noteReachable(n int, ok bool) {
+	if rf.unreachable[n] == !ok {
+		return
+	}
+	rf.unreachable[n] = !ok
+	rf.broadcast(Event{
+		Kind:      EventPeer,
+		Term:      rf.CurrentTerm,
+		State:     rf.state,
+		Leader:    rf.leader,
+		Peer:      n,
+		Reachable: ok,
+	})
+}
+
+func (rf *Raft) broadcast(ev Event) {
+	for _, ob := range rf.observers {
+		ob.enqueue(ev)
+		ob.cond.Signal()
+	}
+}
+
+// should be called when holding the lock
+func (ob *observer) enqueue(ev Event) {
+	for i, old := range ob.queue {
+		if old.Kind != ev.Kind {
+			continue
+		}
+		if ev.Kind == EventPeer && old.Peer == ev.Peer ||
+			ev.Kind != EventPeer && len(ob.queue) >= maxObserverQueue {
+			ob.queue = append(ob.queue[:i], ob.queue[i+1:]...)
+			break
+		}
+	}
+	ob.queue = append(ob.queue, ev)
+}
@@ -0,0 +1,79 @@
+package raft
+
+//
+// tunables for a Raft peer. Make() uses DefaultOptions(),
+// services that need something else call MakeWithOptions().
+//
+
+import (
+	"time"
+
+	"6.824-lab/labclock"
+)
+
+type Options struct {
+	// how many proposals the log writer coalesces into one
+	// persister write (group commit). 1 writes every entry alone.
+	MaxBatchEntries int
+	// how long the log writer lingers for more proposals before
+	// writing a batch. zero writes as soon as it wakes up.
+	BatchWait time.Duration
+	// a new leader appends an EntryNoop in its term, so that entries
+	// from earlier terms commit without waiting for a proposal.
+	NoopOnElection bool
+
+	// backpressure: Propose() fails with ErrProposalDropped, and
+	// Start() returns false, while the leader has this many entries
+	// (or payload bytes) not yet committed, or this many committed
+	// entries not yet sent on applyCh. zero means no limit.
+	MaxUncommittedEntries int
+	MaxUncommittedBytes   int
+	MaxUnappliedEntries   int
+
+	// most entries per ApplyBatch, for a Raft made with
+	// MakeBatched(). zero means everything committed so far.
+	MaxApplyBatch int
+
+	// entries buffered for each Subscribe() channel.
+	SubscribeBuffer int
+
+	// peers that start out as learners, the same on every peer.
+	Learners []int
+	// how many entries behind the leader's last index a learner
+	// may be when Promote()d.
+	PromoteLag int
+
+	// Start() and Propose() on a follower forward the entry to the
+	// leader rather than fail, see Forward().
+	ForwardProposals bool
+
+	// election priority of each peer, the same on every peer;
+	// higher is preferred, see priority.go. nil means all equal.
+	Priorities []int
+	// how many entries behind the leader's last index a preferred
+	// voter may be for the leader to start handing off to it.
+	// proposals then fail with ErrProposalDropped until it has
+	// caught up, or for an election timeout at most.
+	HandOffLag int
+
+	// a leader that hasn't heard from a majority of voters for an
+	// election timeout steps down, so that followers that still get
+	// its heartbeats, but can't answer them, go on to elect another.
+	CheckQuorum bool
+
+	// times every timeout, heartbeat and delay, e.g. a labclock.Sim
+	// to run in simulated time. nil means labclock.Real.
+	Clock labclock.Clock
+	// seeds the election timeouts, plus the peer's index so that
+	// peers sharing Options still draw apart. zero means random.
+	Seed int64
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MaxBatchEntries: 64,
+		BatchWait:       0,
+		SubscribeBuffer: 64,
+		HandOffLag:      64,
+	}
+}
@@ -9,23 +9,38 @@ package raft
 // test with the original before submitting.
 //
 
-import "sync"
+import (
+	"sync"
+	"time"
+
+	"6.824-lab/labclock"
+)
 
 type Persister struct {
 	mu        sync.Mutex
 	raftstate []byte
+	hardstate []byte   // small record rewritten on every term/vote change
+	entries   [][]byte // log region, one encoded record per entry
+	logsize   int      // total bytes held in entries
 	snapshot  []byte
+	latency   time.Duration // simulated disk latency of log writes
+	clock     labclock.Clock
+	logWrites int // SaveLogEntries() calls, see LogWrites()
 }
 
 func MakePersister() *Persister {
-	return &Persister{}
+	return &Persister{clock: labclock.Real}
 }
 
 func (ps *Persister) Copy() *Persister {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	np := MakePersister()
+	np.clock = ps.clock
 	np.raftstate = ps.raftstate
+	np.hardstate = ps.hardstate
+	np.entries = append([][]byte(nil), ps.entries...)
+	np.logsize = ps.logsize
 	np.snapshot = ps.snapshot
 	return np
 }
@@ -42,10 +57,80 @@ func (ps *Persister) ReadRaftState() []byte {
 	return ps.raftstate
 }
 
+// total bytes of Raft state, hard state and log region included,
+// so that services can decide when to snapshot.
 func (ps *Persister) RaftStateSize() int {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
-	return len(ps.raftstate)
+	return len(ps.raftstate) + len(ps.hardstate) + ps.logsize
+}
+
+// replace the hard state record (term, vote, commit hint).
+// it never touches the log region.
+func (ps *Persister) SaveHardState(state []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.hardstate = state
+}
+
+func (ps *Persister) ReadHardState() []byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.hardstate
+}
+
+// drop every record of the log region at position from and beyond,
+// then append entries there. only the new records are written, so
+// appending to the tail costs the size of the tail.
+func (ps *Persister) SaveLogEntries(from int, entries [][]byte) {
+	ps.mu.Lock()
+	latency, clock := ps.latency, ps.clock
+	ps.mu.Unlock()
+	if latency > 0 {
+		clock.Sleep(latency)
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.logWrites++
+	if from < 0 || from > len(ps.entries) {
+		from = len(ps.entries)
+	}
+	for _, e := range ps.entries[from:] {
+		ps.logsize -= len(e)
+	}
+	ps.entries = append(ps.entries[:from], entries...)
+	for _, e := range entries {
+		ps.logsize += len(e)
+	}
+}
+
+// make every log region write take d, as if it went to a slow disk.
+func (ps *Persister) SetLogLatency(d time.Duration) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.latency = d
+}
+
+// time the log latency with clock, e.g. a labclock.Sim.
+func (ps *Persister) SetClock(clock labclock.Clock) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.clock = clock
+}
+
+// how many times the log region has been written, so that tests
+// can tell whether entries were written in batches.
+func (ps *Persister) LogWrites() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.logWrites
+}
+
+func (ps *Persister) ReadLogEntries() [][]byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return append([][]byte(nil), ps.entries...)
 }
 
 // Save both Raft state and K/V snapshot as a single atomic action,
@@ -0,0 +1,124 @@
+package raft
+
+//
+// election priorities. Options.Priorities gives each peer a priority,
+// the same on every peer; higher is preferred, missing means zero.
+//
+// - a peer's election timeout grows with how far it is below the
+//   highest priority, so preferred peers tend to campaign first.
+// - a voter turns down a lower-priority candidate if its own log is
+//   at least as up-to-date. it doesn't campaign at once, its shorter
+//   election timeout sees to that.
+// - a leader hands leadership to a higher-priority voter, as in
+//   the thesis' section 3.10: once the voter is within
+//   Options.HandOffLag entries, the leader stops taking proposals,
+//   and sends TimeoutNow when the voter holds every entry. if the
+//   voter hasn't taken over within an election timeout, proposals
+//   resume, and the leader waits as long again before retrying.
+//
+
+import "time"
+
+// extra election timeout per priority level below the highest.
+const priorityStep = 100 * time.Millisecond
+
+type TimeoutNowArgs struct {
+	Term     int // leader's term
+	LeaderID int
+}
+
+type TimeoutNowReply struct {
+	CurrentTerm int
+}
+
+// should be called when holding the lock
+func (rf *Raft) priority(n int) int {
+	if n < len(rf.opts.Priorities) {
+		return rf.opts.Priorities[n]
+	}
+	return 0
+}
+
+// how much longer than the preferred peers this one waits before
+// campaigning.
+func (rf *Raft) priorityDelay() time.Duration {
+	highest := rf.priority(rf.me)
+	for n := range rf.peers {
+		highest = max(highest, rf.priority(n))
+	}
+	return time.Duration(highest-rf.priority(rf.me)) * priorityStep
+}
+
+// leader starts handing over to peer n if it's a voter preferred
+// over this one and nearly caught up, and sends it TimeoutNow once
+// it holds every entry. should be called when holding the lock
+func (rf *Raft) maybeHandOff(n int) {
+	if rf.learner[n] || rf.priority(n) <= rf.priority(rf.me) {
+		return
+	}
+	last := len(rf.Logs) - 1
+	if !rf.handingOff() {
+		// after a handoff that timed out, let proposals through
+		// for as long again
+		if rf.matchIndex[n] < last-rf.opts.HandOffLag ||
+			rf.clock.Since(rf.handOffStart) < 2*rf.electionTimeout {
+			return
+		}
+		DPrintf("[%d-%s]: leader %d starts handing off to peer %d @ term %d\n", rf.me, rf, rf.me, n, rf.CurrentTerm)
+		rf.handOffTo = n
+		rf.handOffStart = rf.clock.Now()
+	}
+	// one TimeoutNow per handoff, a second could have n campaign twice
+	if rf.handOffTo != n || rf.matchIndex[n] != last || !rf.handOffSent.Before(rf.handOffStart) {
+		return
+	}
+	rf.handOffSent = rf.clock.Now()
+
+	args := TimeoutNowArgs{Term: rf.CurrentTerm, LeaderID: rf.me}
+	DPrintf("[%d-%s]: leader %d hands off to peer %d @ term %d\n", rf.me, rf, rf.me, n, rf.CurrentTerm)
+	go func() {
+		var reply TimeoutNowReply
+		rf.peers[n].TimeoutNow(&args, &reply)
+	}()
+}
+
+// whether this leader is handing off, and so refuses proposals;
+// gives up on a handoff after an election timeout. should be called
+// when holding the lock
+func (rf *Raft) handingOff() bool {
+	if rf.handOffTo >= 0 && rf.clock.Since(rf.handOffStart) >= rf.electionTimeout {
+		DPrintf("[%d-%s]: leader %d gives up handing off to peer %d\n", rf.me, rf, rf.me, rf.handOffTo)
+		rf.handOffTo = -1
+	}
+	return rf.handOffTo >= 0
+}
+
+// TimeoutNow RPC handler, the leader asks this peer to campaign now
+func (rf *Raft) TimeoutNow(args *TimeoutNowArgs, reply *TimeoutNowReply) {
+	select {
+	case <-rf.shutdownCh:
+		return
+	default:
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	reply.CurrentTerm = rf.CurrentTerm
+	if args.Term != rf.CurrentTerm || rf.leader != args.LeaderID || rf.learner[rf.me] {
+		return
+	}
+	DPrintf("[%d-%s]: peer %d told to campaign by leader %d\n", rf.me, rf, rf.me, args.LeaderID)
+	go rf.canvassVotes(true)
+}
+
+// whether this peer, a voter, should refuse its vote to a
+// lower-priority candidate: its log is at least as up-to-date.
+// should be called when holding the lock
+func (rf *Raft) outranks(args *RequestVoteArgs) bool {
+	if rf.priority(rf.me) <= rf.priority(args.CandidateID) {
+		return false
+	}
+	lastLogIdx, lastLogTerm := rf.lastLogIndexAndTerm()
+	return lastLogTerm > args.LastLogTerm ||
+		(lastLogTerm == args.LastLogTerm && lastLogIdx >= args.LastLogIndex)
+}
@@ -18,12 +18,16 @@ package raft
 //
 
 import (
+	"bytes"
+	"errors"
 	"math/rand"
 	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"6.824-lab/labclock"
+	"6.824-lab/labgob"
 	"6.824-lab/labrpc"
 )
 
@@ -41,9 +45,6 @@ func min(a, b int) int {
 	return b
 }
 
-// import "bytes"
-// import "labgob"
-
 //
 // as each Raft peer becomes aware that successive log entries are
 // committed, the peer should send an ApplyMsg to the service (or
@@ -57,20 +58,71 @@ func min(a, b int) int {
 //
 type ApplyMsg struct {
 	CommandValid bool
-	Command      interface{}
+	Command      interface{} // what was passed to Start(), nil for Propose()
 	CommandIndex int
+	Data         []byte // the entry's payload, what was passed to Propose()
+
+	// a service whose proposal at CommandIndex was made in another
+	// term knows it was overwritten by a different leader.
+	CommandTerm int
+	CommandType EntryType
+	ProposeTime time.Time // when the leader accepted the entry
+	CommitTime  time.Time // when this peer learned it was committed
+}
+
+// committed entries delivered together, see MakeBatched().
+type ApplyBatch struct {
+	Entries []ApplyMsg // consecutive, in index order
 }
 
+type EntryType int
+
+const (
+	EntryNormal     EntryType = iota // opaque payload from Propose()
+	EntryCommand                     // labgob-encoded command from Start()
+	EntryNoop                        // appended by a new leader, no payload
+	EntryConfChange                  // a ConfChange, see Promote()
+)
+
 // Log Entry
 type LogEntry struct {
-	Term    int
-	Command interface{}
+	Term        int
+	Type        EntryType
+	Data        []byte
+	ProposeTime int64 // leader's clock, in unix nanoseconds
+}
+
+var ErrNotLeader = errors.New("raft: not the leader")
+
+// the proposal would exceed one of the limits in Options,
+// the service should back off and retry.
+var ErrProposalDropped = errors.New("raft: proposal dropped")
+
+func encodeCommand(command interface{}) []byte {
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(&command)
+	return w.Bytes()
 }
 
+func decodeCommand(data []byte) interface{} {
+	var command interface{}
+	d := labgob.NewDecoder(bytes.NewBuffer(data))
+	if err := d.Decode(&command); err != nil {
+		DPrintf("failed to decode command: %v\n", err)
+		return nil
+	}
+	return command
+}
+
+// no peer times out sooner than this after hearing from a leader.
+const minElectionTimeout = 400 * time.Millisecond
+
 const (
 	Follower = iota
 	Candidate
 	Leader
+	Learner // follows the log, never votes or stands for election
 )
 
 //
@@ -78,7 +130,7 @@ const (
 //
 type Raft struct {
 	mu        sync.Mutex          // Lock to protect shared access to this peer's state
-	peers     []*labrpc.ClientEnd // RPC end points of all peers
+	peers     []Peer              // RPC end points of all peers
 	persister *Persister          // Object to hold this peer's persisted state
 	me        int                 // this peer's index into peers[]
 	dead      int32               // set by Kill()
@@ -86,11 +138,13 @@ type Raft struct {
 	// Your data here (2A, 2B, 2C).
 	// Look at the paper's Figure 2 for a description of what
 	// state a Raft server must maintain.
-	state             int           // follower, candidate or leader
-	resetTimer        chan struct{} // for reset election timer
-	electionTimer     *time.Timer   // election timer
-	electionTimeout   time.Duration // 400~800ms
-	heartbeatInterval time.Duration // 100ms
+	state             int            // follower, candidate or leader
+	resetTimer        chan struct{}  // for reset election timer
+	clock             labclock.Clock // Options.Clock, or real time
+	electionTimer     labclock.Timer // election timer
+	electionTimeout   time.Duration  // 400~800ms
+	heartbeatInterval time.Duration  // 100ms
+	rand              *rand.Rand     // draws election timeouts, see Options.Seed
 
 	CurrentTerm int        // Persisted before responding to RPCs
 	VotedFor    int        // Persisted before responding to RPCs
@@ -103,6 +157,41 @@ type Raft struct {
 	matchIndex  []int         // Leader only, reinitialized after election
 	applyCh     chan ApplyMsg // outgoing channel to service
 	shutdownCh  chan struct{} // shutdown channel, shut raft instance gracefully
+
+	opts           Options
+	persistedIndex int        // last log index written to the persister
+	flushCond      *sync.Cond // for new entries waiting to be written
+	writing        bool       // log writer is writing outside the lock
+	writeCond      *sync.Cond // for the log writer finishing a write
+	delivered      int64      // last index sent on applyCh, atomic
+	metrics        Metrics
+
+	applyBatchCh chan ApplyBatch // instead of applyCh, see MakeBatched()
+	digests      []uint64        // LogDigest() of each committed prefix
+	commitTimes  []int64         // per index, when it was committed here, see commitTo()
+	pendingBytes int             // len(Data) summed over Logs[commitIndex+1:]
+
+	leader      int         // last known leader of CurrentTerm, -1 if none
+	observers   []*observer // see Observe()
+	observed    Event       // state, term and leader last emitted
+	unreachable []bool      // per peer, whether its last RPC failed
+
+	learner   []bool // per peer, non-voting until promoted
+	confIndex int    // index of the last EntryConfChange in the log
+
+	leaderCommit int         // highest leader commit index heard of
+	lastContact  time.Time   // last valid AE from a leader
+	lastAck      []time.Time // leader only, when each peer's last acked AE was sent
+	leaderSince  time.Time   // leader only, when it won its election
+
+	forwardClient int64                         // see newForwardClient()
+	forwardSeq    int64                         // last Seq this peer forwarded
+	forwarding    map[int64]bool                // Seqs waiting for the leader's reply
+	forwarded     map[int64]map[int64]forwarded // leader only, per Client, see Forward()
+
+	handOffTo    int       // leader only, peer being handed off to, -1 if none
+	handOffStart time.Time // leader only, when the last handoff began
+	handOffSent  time.Time // leader only, last TimeoutNow, see maybeHandOff()
 }
 
 // return currentTerm and whether this server
@@ -121,41 +210,99 @@ func (rf *Raft) GetState() (int, bool) {
 }
 
 //
-// save Raft's persistent state to stable storage,
+// save Raft's hard state (term, vote and a commit hint) to stable storage,
 // where it can later be retrieved after a crash and restart.
-// see paper's Figure 2 for a description of what should be persistent.
+// the log lives in its own region, see persistLog(), so a vote or
+// term bump only rewrites a few bytes.
+// should be called when holding the lock
 //
 func (rf *Raft) persist() {
-	// Your code here (2C).
-	// Example:
-	// w := new(bytes.Buffer)
-	// e := labgob.NewEncoder(w)
-	// e.Encode(rf.xxx)
-	// e.Encode(rf.yyy)
-	// data := w.Bytes()
-	// rf.persister.SaveRaftState(data)
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(rf.CurrentTerm)
+	e.Encode(rf.VotedFor)
+	e.Encode(rf.commitIndex)
+	rf.persister.SaveHardState(w.Bytes())
+}
+
+//
+// save log entries from index from to index to, replacing what the log
+// region held at and after from. entries before from are never rewritten.
+// should be called when holding the lock
+//
+func (rf *Raft) persistLog(from, to int) {
+	// Logs[0] is a placeholder and is not persisted
+	rf.persister.SaveLogEntries(from-1, encodeEntries(rf.Logs[from:to+1]))
+	rf.persistedIndex = to
+}
+
+func encodeEntries(entries []LogEntry) [][]byte {
+	data := make([][]byte, 0, len(entries))
+	for _, entry := range entries {
+		w := new(bytes.Buffer)
+		e := labgob.NewEncoder(w)
+		e.Encode(entry)
+		data = append(data, w.Bytes())
+	}
+	return data
 }
 
 //
 // restore previously persisted state.
 //
-func (rf *Raft) readPersist(data []byte) {
-	if data == nil || len(data) < 1 { // bootstrap without any state?
-		return
+func (rf *Raft) readPersist(hardstate []byte, entries [][]byte) {
+	hint := 0 // commitIndex as of the crash
+	if len(hardstate) > 0 {
+		r := bytes.NewBuffer(hardstate)
+		d := labgob.NewDecoder(r)
+		var term, votedFor, commitIndex int
+		if d.Decode(&term) != nil ||
+			d.Decode(&votedFor) != nil ||
+			d.Decode(&commitIndex) != nil {
+			DPrintf("[%d-%s]: failed to decode hard state\n", rf.me, rf)
+			return
+		}
+		rf.CurrentTerm = term
+		rf.VotedFor = votedFor
+		hint = commitIndex
+	}
+	for i, data := range entries {
+		d := labgob.NewDecoder(bytes.NewBuffer(data))
+		var entry LogEntry
+		if d.Decode(&entry) != nil {
+			DPrintf("[%d-%s]: failed to decode log entry %d\n", rf.me, rf, i+1)
+			break
+		}
+		rf.Logs = append(rf.Logs, entry)
+		rf.pendingBytes += len(entry.Data)
 	}
-	// Your code here (2C).
-	// Example:
-	// r := bytes.NewBuffer(data)
-	// d := labgob.NewDecoder(r)
-	// var xxx
-	// var yyy
-	// if d.Decode(&xxx) != nil ||
-	//    d.Decode(&yyy) != nil {
-	//   error...
-	// } else {
-	//   rf.xxx = xxx
-	//   rf.yyy = yyy
-	// }
+	rf.persistedIndex = len(rf.Logs) - 1
+	// the commit hint may be ahead of what was made durable
+	rf.commitTo(min(hint, rf.persistedIndex))
+}
+
+// set commitIndex, noting when each newly committed index was
+// committed: now, as far as this peer knows. entries committed
+// before a restart count as committed at the restart.
+// should be called when holding the lock
+func (rf *Raft) commitTo(index int) {
+	now := rf.clock.Now().UnixNano()
+	for len(rf.commitTimes) <= index {
+		rf.commitTimes = append(rf.commitTimes, now)
+	}
+	for i := rf.commitIndex + 1; i <= index; i++ {
+		rf.pendingBytes -= len(rf.Logs[i].Data)
+	}
+	for i := index + 1; i <= rf.commitIndex; i++ {
+		rf.pendingBytes += len(rf.Logs[i].Data)
+	}
+	rf.commitIndex = index
+}
+
+// when entries lo..lo+n-1 were committed, should be called when
+// holding the lock
+func (rf *Raft) commitTimesOf(lo int, n int) []int64 {
+	return append([]int64(nil), rf.commitTimes[lo:lo+n]...)
 }
 
 //
@@ -164,24 +311,37 @@ func (rf *Raft) readPersist(data []byte) {
 //
 type RequestVoteArgs struct {
 	// Your data here (2A, 2B).
-	Term         int // candidate's term
-	CandidateID  int // candidate requesting vote
-	LastLogIndex int // index of candidate's last log entry
-	LastLogTerm  int // term of candidate's last log entry
+	Term         int  // candidate's term
+	CandidateID  int  // candidate requesting vote
+	LastLogIndex int  // index of candidate's last log entry
+	LastLogTerm  int  // term of candidate's last log entry
+	Transfer     bool // the leader asked for this election, see TimeoutNow()
+	PreVote      bool // would the voter grant Term? it changes nothing, see preVote()
 }
 
-func (rf *Raft) fillRequestVoteArgs(args *RequestVoteArgs) {
+// returns the voters to canvass, or false if this peer is a learner
+// and must not stand for election.
+func (rf *Raft) fillRequestVoteArgs(args *RequestVoteArgs, transfer bool) ([]int, bool) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
+	if rf.learner[rf.me] {
+		return nil, false
+	}
+	DPrintf("[%d-%s]: peer %d election timeout, issue election @ term %d\n", rf.me, rf, rf.me, rf.CurrentTerm)
 
 	// turn to candidate and vote to itself
 	rf.VotedFor = rf.me
 	rf.CurrentTerm += 1
 	rf.state = Candidate
+	rf.leader = -1
+	rf.persist()
+	rf.noteChanges()
 
 	args.Term = rf.CurrentTerm
 	args.CandidateID = rf.me
+	args.Transfer = transfer
 	args.LastLogIndex, args.LastLogTerm = rf.lastLogIndexAndTerm()
+	return rf.voters(), true
 }
 
 //
@@ -210,6 +370,18 @@ func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 	defer rf.mu.Unlock()
 
 	lastLogIdx, lastLogTerm := rf.lastLogIndexAndTerm()
+	if args.PreVote {
+		// the vote it would get, with no term, vote or timer change
+		reply.CurrentTerm = rf.CurrentTerm
+		reply.VoteGranted = args.Term > rf.CurrentTerm && !rf.leaderAlive() &&
+			!rf.learner[rf.me] && !rf.outranks(args) &&
+			((args.LastLogTerm == lastLogTerm && args.LastLogIndex >= lastLogIdx) ||
+				args.LastLogTerm > lastLogTerm)
+		return
+	}
+	// hard state must be durable before the reply goes out
+	defer rf.persist()
+	defer rf.noteChanges()
 
 	DPrintf("[%d-%s]: rpc RV, from peer: %d, arg term: %d, my term: %d (last log idx: %d->%d, term: %d->%d)\n", rf.me, rf, args.CandidateID, args.Term, rf.CurrentTerm, args.LastLogIndex,
 		lastLogIdx, args.LastLogTerm, lastLogTerm)
@@ -217,16 +389,24 @@ func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 	if args.Term < rf.CurrentTerm {
 		reply.CurrentTerm = rf.CurrentTerm
 		reply.VoteGranted = false
+	} else if !args.Transfer && rf.leaderAlive() {
+		// a live leader keeps its term, however eager the candidate
+		DPrintf("[%d-%s]: peer %d ignores RV from peer %d, leader %d is alive\n",
+			rf.me, rf, rf.me, args.CandidateID, rf.leader)
+		reply.CurrentTerm = rf.CurrentTerm
+		reply.VoteGranted = false
 	} else {
 		if args.Term > rf.CurrentTerm {
 			// convert to follower
 			rf.CurrentTerm = args.Term
-			rf.state = Follower
+			rf.state = rf.followerState()
 			rf.VotedFor = -1
+			rf.leader = -1
 		}
 
 		// if is null (follower) or itself is a candidate (or stale leader) with same term
-		if rf.VotedFor == -1 { //|| (rf.VotedFor == rf.me && !sameTerm) { //|| rf.votedFor == args.CandidateID {
+		// learners don't vote
+		if rf.VotedFor == -1 && !rf.learner[rf.me] && !rf.outranks(args) { //|| (rf.VotedFor == rf.me && !sameTerm) { //|| rf.votedFor == args.CandidateID {
 			// check whether candidate's log is at-least-as update
 			if (args.LastLogTerm == lastLogTerm && args.LastLogIndex >= lastLogIdx) ||
 				args.LastLogTerm > lastLogTerm {
@@ -244,6 +424,32 @@ func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 	}
 }
 
+// whether this peer heard from a leader within the minimum election
+// timeout; a leader asks whether a majority still follows it.
+// should be called when holding the lock
+func (rf *Raft) leaderAlive() bool {
+	if rf.state == Leader {
+		return rf.clock.Since(rf.quorumContact()) < minElectionTimeout
+	}
+	return rf.leader != -1 && rf.clock.Since(rf.lastContact) < minElectionTimeout
+}
+
+// with Options.CheckQuorum, a leader that hasn't heard from a
+// majority for an election timeout steps down; returns whether it
+// did. should be called when holding the lock
+func (rf *Raft) checkQuorum() bool {
+	if !rf.opts.CheckQuorum || rf.state != Leader ||
+		rf.clock.Since(rf.leaderSince) < rf.electionTimeout ||
+		rf.clock.Since(rf.quorumContact()) < rf.electionTimeout {
+		return false
+	}
+	DPrintf("[%d-%s]: leader %d lost contact with a majority, stepping down\n", rf.me, rf, rf.me)
+	rf.state = rf.followerState()
+	rf.leader = -1
+	rf.noteChanges()
+	return true
+}
+
 // should be called when holding the lock
 func (rf *Raft) lastLogIndexAndTerm() (int, int) {
 	index := len(rf.Logs) - 1
@@ -253,7 +459,8 @@ func (rf *Raft) lastLogIndexAndTerm() (int, int) {
 
 //
 // example code to send a RequestVote RPC to a server.
-// server is the index of the target server in rf.peers[].
+// server is the index of the target server in rf.peers[],
+// a Peer (see transport.go); over labrpc this is a Call().
 // expects RPC arguments in args.
 // fills in *reply with RPC reply, so caller should
 // pass &reply.
@@ -281,7 +488,7 @@ func (rf *Raft) lastLogIndexAndTerm() (int, int) {
 // the struct itself.
 //
 func (rf *Raft) sendRequestVote(server int, args *RequestVoteArgs, reply *RequestVoteReply) bool {
-	ok := rf.peers[server].Call("Raft.RequestVote", args, reply)
+	ok := rf.peers[server].RequestVote(args, reply)
 	return ok
 }
 
@@ -305,8 +512,9 @@ type AppendEntriesReply struct {
 
 // should be called when holding lock
 func (rf *Raft) turnToFollow() {
-	rf.state = Follower
+	rf.state = rf.followerState()
 	rf.VotedFor = -1
+	rf.leader = -1
 }
 
 func (rf *Raft) String() string {
@@ -317,6 +525,8 @@ func (rf *Raft) String() string {
 		return "c"
 	case Follower:
 		return "f"
+	case Learner:
+		return "r"
 	default:
 		return ""
 	}
@@ -334,6 +544,11 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 	DPrintf("[%d-%s]: rpc AE, from peer: %d, term: %d\n", rf.me, rf, args.LeaderID, args.Term)
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
+	// a batch the log writer has in flight must land first,
+	// or it could overwrite what this RPC writes
+	for rf.writing {
+		rf.writeCond.Wait()
+	}
 
 	if args.Term < rf.CurrentTerm {
 		//DPrintf("[%d-%s]: AE failed from leader %d. (heartbeat: leader's term < follower's term (%d < %d))\n",
@@ -342,6 +557,7 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 		reply.Success = false
 		return
 	}
+	term, votedFor := rf.CurrentTerm, rf.VotedFor
 	if rf.CurrentTerm < args.Term {
 		rf.CurrentTerm = args.Term
 	}
@@ -354,10 +570,19 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 	if rf.VotedFor != args.LeaderID {
 		rf.VotedFor = args.LeaderID
 	}
+	if term != rf.CurrentTerm || votedFor != rf.VotedFor {
+		rf.persist()
+	}
+	// a candidate of this term steps down, too
+	rf.state = rf.followerState()
+	rf.leader = args.LeaderID
+	rf.noteChanges()
 
 	// valid AE, reset election timer
 	// if the node recieve heartbeat. then it will reset the election timeout
 	rf.resetTimer <- struct{}{}
+	rf.lastContact = rf.clock.Now()
+	rf.leaderCommit = max(rf.leaderCommit, args.LeaderCommit)
 
 	preLogIdx, preLogTerm := 0, 0
 	if args.PrevLogIndex < len(rf.Logs) {
@@ -368,14 +593,37 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 	// last log is match
 	if preLogIdx == args.PrevLogIndex && preLogTerm == args.PrevLogTerm {
 		reply.Success = true
-		// truncate to known match
-		rf.Logs = rf.Logs[:preLogIdx+1]
-		rf.Logs = append(rf.Logs, args.Entries...)
-		var last = len(rf.Logs) - 1
+		// skip entries already in the log, truncate only on a conflict:
+		// a delayed AE carrying fewer entries must not drop ones a later
+		// AE appended, the leader may have counted them toward commit.
+		var i = 0
+		for ; i < len(args.Entries); i++ {
+			idx := preLogIdx + 1 + i
+			if idx >= len(rf.Logs) || rf.Logs[idx].Term != args.Entries[i].Term {
+				break
+			}
+		}
+		var from = len(rf.Logs)
+		if i < len(args.Entries) {
+			from = preLogIdx + 1 + i
+			for j := max(from, rf.commitIndex+1); j < len(rf.Logs); j++ {
+				rf.pendingBytes -= len(rf.Logs[j].Data)
+			}
+			rf.Logs = append(rf.Logs[:from], args.Entries[i:]...)
+			for j := max(from, rf.commitIndex+1); j < len(rf.Logs); j++ {
+				rf.pendingBytes += len(rf.Logs[j].Data)
+			}
+			rf.updateConfig(from)
+		}
+		var last = preLogIdx + len(args.Entries) // index of last new entry
+		if from < len(rf.Logs) || rf.persistedIndex < last {
+			// entries this peer appended as leader may not be written yet
+			rf.persistLog(min(rf.persistedIndex+1, from), len(rf.Logs)-1)
+		}
 
 		// min(leaderCommit, index of last new entry)
 		if args.LeaderCommit > rf.commitIndex {
-			rf.commitIndex = min(args.LeaderCommit, last)
+			rf.commitTo(min(args.LeaderCommit, last))
 			// signal possible update commit index
 			go func() { rf.commitCond.Broadcast() }()
 		}
@@ -442,40 +690,96 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 // the first return value is the index that the command will appear at
 // if it's ever committed. the second return value is the current
 // term. the third return value is true if this server believes it is
-// the leader.
+// the leader, or forwarded the command to the leader (see
+// Options.ForwardProposals), and the command was not dropped for
+// backpressure (see Options); Propose() tells the two apart.
 //
 func (rf *Raft) Start(command interface{}) (int, int, bool) {
-	index := -1
-	term := 0
-	isLeader := false
+	index, term, err := rf.proposeOrForward(EntryCommand, encodeCommand(command))
+	return index, term, err == nil
+}
 
-	// Your code here (2B).
+//
+// like Start(), but the command is an opaque payload that is
+// handed back untouched in ApplyMsg.Data, with no labgob
+// registration or encoding on the way. returns ErrNotLeader if
+// this server isn't the leader.
+//
+func (rf *Raft) Propose(data []byte) (int, int, error) {
+	return rf.proposeOrForward(EntryNormal, data)
+}
+
+func (rf *Raft) propose(typ EntryType, data []byte) (int, int, error) {
 	select {
 	case <-rf.shutdownCh:
-		return -1, 0, false
+		return -1, 0, ErrNotLeader
 	default:
-		rf.mu.Lock()
-		defer rf.mu.Unlock()
-		// Your code here (2B).
-		if rf.state == Leader {
-			log := LogEntry{rf.CurrentTerm, command}
-			rf.Logs = append(rf.Logs, log)
+	}
 
-			index = len(rf.Logs) - 1
-			term = rf.CurrentTerm
-			isLeader = true
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.state != Leader {
+		return -1, 0, ErrNotLeader
+	}
+	if !rf.admitProposal(len(data)) {
+		rf.metrics.ProposalsDropped++
+		DPrintf("[%d-%s]: client entry dropped, commit index %d, last index %d\n",
+			rf.me, rf, rf.commitIndex, len(rf.Logs)-1)
+		return -1, 0, ErrProposalDropped
+	}
 
-			//DPrintf("[%d-%s]: client add new entry (%d-%v), logs: %v\n", rf.me, rf, index, command, rf.logs)
-			DPrintf("[%d-%s]: client add new entry (%d)\n", rf.me, rf, index)
-			//DPrintf("[%d-%s]: client add new entry (%d-%v)\n", rf.me, rf, index, command)
+	index := rf.appendEntry(typ, data)
+	rf.metrics.ProposalsAccepted++
+	DPrintf("[%d-%s]: client add new entry (%d)\n", rf.me, rf, index)
+	return index, rf.CurrentTerm, nil
+}
 
-			// only update leader
-			rf.nextIndex[rf.me] = index + 1
-			rf.matchIndex[rf.me] = index
+// check a proposal of size bytes against the limits in Options,
+// and any handoff under way. should be called when holding the lock
+func (rf *Raft) admitProposal(size int) bool {
+	if rf.handingOff() {
+		rf.metrics.DroppedHandOff++
+		return false
+	}
+	uncommitted := len(rf.Logs) - 1 - rf.commitIndex
+	if limit := rf.opts.MaxUncommittedEntries; limit > 0 && uncommitted >= limit {
+		rf.metrics.DroppedUncommittedEntries++
+		return false
+	}
+	if limit := rf.opts.MaxUncommittedBytes; limit > 0 {
+		// always let a single entry through, however big
+		if rf.pendingBytes+size > limit && uncommitted > 0 {
+			rf.metrics.DroppedUncommittedBytes++
+			return false
 		}
 	}
+	unapplied := rf.commitIndex - int(atomic.LoadInt64(&rf.delivered))
+	if limit := rf.opts.MaxUnappliedEntries; limit > 0 && unapplied >= limit {
+		rf.metrics.DroppedUnappliedEntries++
+		return false
+	}
+	return true
+}
+
+// leader appends a new entry in its term, should be called when holding the lock
+func (rf *Raft) appendEntry(typ EntryType, data []byte) int {
+	log := LogEntry{
+		Term:        rf.CurrentTerm,
+		Type:        typ,
+		Data:        data,
+		ProposeTime: rf.clock.Now().UnixNano(),
+	}
+	rf.Logs = append(rf.Logs, log)
+	rf.pendingBytes += len(data)
+	index := len(rf.Logs) - 1
 
-	return index, term, isLeader
+	// only update leader, matchIndex waits for the log writer
+	rf.nextIndex[rf.me] = index + 1
+	if typ == EntryConfChange {
+		rf.updateConfig(index)
+	}
+	rf.flushCond.Signal()
+	return index
 }
 
 //
@@ -502,26 +806,35 @@ func (rf *Raft) killed() bool {
 func (rf *Raft) resetOnElection() {
 	count := len(rf.peers)
 	length := len(rf.Logs)
+	rf.forwarded = make(map[int64]map[int64]forwarded)
+	rf.leaderSince = rf.clock.Now()
+	rf.handOffTo = -1
+	rf.handOffStart = time.Time{}
 
 	for i := 0; i < count; i++ {
 		rf.matchIndex[i] = 0
 		rf.nextIndex[i] = length
+		rf.lastAck[i] = time.Time{}
 		if i == rf.me {
-			rf.matchIndex[i] = length - 1
+			rf.matchIndex[i] = rf.persistedIndex
 		}
 	}
 }
 
 // updateCommitIndex find new commit id, must be called when hold lock
 func (rf *Raft) updateCommitIndex() {
-	match := make([]int, len(rf.matchIndex))
-	copy(match, rf.matchIndex)
+	// learners don't count toward the majority
+	voters := rf.voters()
+	match := make([]int, len(voters))
+	for i, n := range voters {
+		match[i] = rf.matchIndex[n]
+	}
 	sort.Ints(match)
 
 	DPrintf("[%d-%s]: leader %d try to update commit index: %v @ term %d.\n",
 		rf.me, rf, rf.me, rf.matchIndex, rf.CurrentTerm)
 
-	target := match[len(rf.peers)/2]
+	target := match[(len(match)-1)/2]
 	if rf.commitIndex < target {
 		//fmt.Println("target:",target,match)
 		if rf.Logs[target].Term == rf.CurrentTerm {
@@ -531,7 +844,7 @@ func (rf *Raft) updateCommitIndex() {
 			DPrintf("[%d-%s]: leader %d update commit index %d -> %d @ term %d\n",
 				rf.me, rf, rf.me, rf.commitIndex, target, rf.CurrentTerm)
 
-			rf.commitIndex = target
+			rf.commitTo(target)
 			go func() { rf.commitCond.Broadcast() }()
 		} else {
 			DPrintf("[%d-%s]: leader %d update commit index %d failed (log term %d != current Term %d)\n",
@@ -541,22 +854,30 @@ func (rf *Raft) updateCommitIndex() {
 }
 
 // n: which follower
-func (rf *Raft) consistencyCheckReplyHandler(n int, reply *AppendEntriesReply) {
+func (rf *Raft) consistencyCheckReplyHandler(n int, term int, sent time.Time, reply *AppendEntriesReply) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
 
 	if rf.state != Leader {
 		return
 	}
+	if reply.CurrentTerm <= term && rf.CurrentTerm == term && sent.After(rf.lastAck[n]) {
+		// peer n still followed this leader when the AE went out
+		rf.lastAck[n] = sent
+	}
 	if reply.Success {
 		// RPC and consistency check successful
 		rf.matchIndex[n] = reply.FirstIndex
 		rf.nextIndex[n] = rf.matchIndex[n] + 1
 		rf.updateCommitIndex() // try to update commitIndex
+		rf.maybeHandOff(n)
 	} else {
 		// found a new leader? turn to follower
 		if rf.state == Leader && reply.CurrentTerm > rf.CurrentTerm {
+			rf.CurrentTerm = reply.CurrentTerm
 			rf.turnToFollow()
+			rf.persist()
+			rf.noteChanges()
 			rf.resetTimer <- struct{}{}
 			DPrintf("[%d-%s]: leader %d found new term (heartbeat resp from peer %d), turn to follower.",
 				rf.me, rf, rf.me, n)
@@ -591,13 +912,17 @@ func (rf *Raft) consistencyCheckReplyHandler(n int, reply *AppendEntriesReply) {
 
 // bool is not useful
 func (rf *Raft) sendAppendEntries(server int, args *AppendEntriesArgs, reply *AppendEntriesReply) bool {
-	ok := rf.peers[server].Call("Raft.AppendEntries", args, reply)
+	ok := rf.peers[server].AppendEntries(args, reply)
 	return ok
 }
 
 func (rf *Raft) consistencyCheck(n int) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
+	// stepped down since this was kicked off
+	if rf.state != Leader {
+		return
+	}
 	pre := max(1,rf.nextIndex[n])
 	var args = AppendEntriesArgs{
 		Term:         rf.CurrentTerm,
@@ -615,8 +940,13 @@ func (rf *Raft) consistencyCheck(n int) {
 	go func() {
 		DPrintf("[%d-%s]: consistency Check to peer %d.\n", rf.me, rf, n)
 		var reply AppendEntriesReply
-		if rf.sendAppendEntries(n, &args, &reply) {
-			rf.consistencyCheckReplyHandler(n, &reply)
+		sent := rf.clock.Now()
+		ok := rf.sendAppendEntries(n, &args, &reply)
+		rf.mu.Lock()
+		rf.noteReachable(n, ok)
+		rf.mu.Unlock()
+		if ok {
+			rf.consistencyCheckReplyHandler(n, args.Term, sent, &reply)
 		}
 	}()
 }
@@ -625,7 +955,10 @@ func (rf *Raft) consistencyCheck(n int) {
 // Only leader can issue heartbeat message.
 func (rf *Raft) heartbeatDaemon() {
 	for {
-		if _, isLeader := rf.GetState(); !isLeader {
+		rf.mu.Lock()
+		stepDown := rf.checkQuorum()
+		rf.mu.Unlock()
+		if _, isLeader := rf.GetState(); stepDown || !isLeader {
 			return
 		}
 		// reset leader's election timer
@@ -641,7 +974,7 @@ func (rf *Raft) heartbeatDaemon() {
 				}
 			}
 		}
-		time.Sleep(rf.heartbeatInterval)
+		rf.clock.Sleep(rf.heartbeatInterval)
 	}
 }
 
@@ -654,24 +987,40 @@ func (rf *Raft) electionDaemon() {
 			return
 		case <-rf.resetTimer:
 			if !rf.electionTimer.Stop() {
-				<-rf.electionTimer.C
+				<-rf.electionTimer.C()
 			}
-			rf.electionTimer.Reset(rf.electionTimeout)
-		case <-rf.electionTimer.C:
-			rf.mu.Lock()
-			DPrintf("[%d-%s]: peer %d election timeout, issue election @ term %d\n", rf.me, rf, rf.me, rf.CurrentTerm)
-			rf.mu.Unlock()
-			go rf.canvassVotes()
-			rf.electionTimer.Reset(rf.electionTimeout)
+			// a new draw each time too: a candidate that never hears
+			// back keeps winning votes, and resetting the voters'
+			// timers; with fixed timeouts it could always go first
+			rf.electionTimer.Reset(rf.randomTimeout())
+		case <-rf.electionTimer.C():
+			// must not take rf.mu here, lock holders block on resetTimer
+			go rf.canvassVotes(false)
+			// a new draw for the retry, lest the same peer start every
+			// election first and keep splitting the vote
+			rf.electionTimer.Reset(rf.randomTimeout())
 		}
 	}
 }
 
-// canvassVotes issues RequestVote RPC
-func (rf *Raft) canvassVotes() {
+// minElectionTimeout plus a random 0~400ms, plus the priority delay.
+func (rf *Raft) randomTimeout() time.Duration {
+	return minElectionTimeout + time.Millisecond*time.Duration(rf.rand.Intn(100)*4) + rf.priorityDelay()
+}
+
+// canvassVotes issues RequestVote RPC, transfer tells voters the
+// leader asked for this election
+func (rf *Raft) canvassVotes(transfer bool) {
+	// the leader vouches for a transfer, no need to ask first
+	if !transfer && !rf.preVote() {
+		return
+	}
 	var voteArgs RequestVoteArgs
-	rf.fillRequestVoteArgs(&voteArgs)
-	peers := len(rf.peers)
+	voters, ok := rf.fillRequestVoteArgs(&voteArgs, transfer)
+	if !ok {
+		return
+	}
+	peers := len(voters)
 
 	var votes = 1
 	replyHandler := func(reply *RequestVoteReply) {
@@ -681,14 +1030,20 @@ func (rf *Raft) canvassVotes() {
 			if reply.CurrentTerm > voteArgs.Term {
 				rf.CurrentTerm = reply.CurrentTerm
 				rf.turnToFollow()
-				//rf.persist()
+				rf.persist()
+				rf.noteChanges()
 				rf.resetTimer <- struct{}{} // reset timer
 				return
 			}
 			if reply.VoteGranted {
 				if votes == peers/2 {
 					rf.state = Leader
-					rf.resetOnElection()    // reset leader state
+					rf.leader = rf.me
+					rf.noteChanges()
+					rf.resetOnElection() // reset leader state
+					if rf.opts.NoopOnElection {
+						rf.appendEntry(EntryNoop, nil)
+					}
 					go rf.heartbeatDaemon() // new leader, start heartbeat daemon
 					DPrintf("[%d-%s]: peer %d become new leader.\n", rf.me, rf, rf.me)
 					return
@@ -697,11 +1052,15 @@ func (rf *Raft) canvassVotes() {
 			}
 		}
 	}
-	for i := 0; i < peers; i++ {
+	for _, i := range voters {
 		if i != rf.me {
 			go func(n int) {
 				var reply RequestVoteReply
-				if rf.sendRequestVote(n, &voteArgs, &reply) {
+				ok := rf.sendRequestVote(n, &voteArgs, &reply)
+				rf.mu.Lock()
+				rf.noteReachable(n, ok)
+				rf.mu.Unlock()
+				if ok {
 					replyHandler(&reply)
 				}
 			}(i)
@@ -709,6 +1068,117 @@ func (rf *Raft) canvassVotes() {
 	}
 }
 
+// preVote asks the voters whether they would vote for this peer in
+// the next term, without bumping its own (thesis section 9.6). a
+// peer that can't win, e.g. one that was cut off while the others
+// kept hearing from the leader, so never inflates its term, which
+// would otherwise depose that leader through its AE replies.
+func (rf *Raft) preVote() bool {
+	rf.mu.Lock()
+	if rf.learner[rf.me] {
+		rf.mu.Unlock()
+		return false
+	}
+	args := RequestVoteArgs{
+		Term:        rf.CurrentTerm + 1,
+		CandidateID: rf.me,
+		PreVote:     true,
+	}
+	args.LastLogIndex, args.LastLogTerm = rf.lastLogIndexAndTerm()
+	voters := rf.voters()
+	rf.mu.Unlock()
+
+	granted := make(chan bool, len(voters))
+	for _, i := range voters {
+		if i != rf.me {
+			go func(n int) {
+				var reply RequestVoteReply
+				ok := rf.sendRequestVote(n, &args, &reply)
+				rf.mu.Lock()
+				rf.noteReachable(n, ok)
+				rf.mu.Unlock()
+				granted <- ok && reply.VoteGranted
+			}(i)
+		}
+	}
+	votes, replies := 1, 1
+	timeout := rf.clock.After(minElectionTimeout)
+	for votes <= len(voters)/2 && replies < len(voters) {
+		select {
+		case ok := <-granted:
+			replies++
+			if ok {
+				votes++
+			}
+		case <-timeout:
+			return false
+		case <-rf.shutdownCh:
+			return false
+		}
+	}
+	DPrintf("[%d-%s]: peer %d pre-vote for term %d, %d of %d votes\n", rf.me, rf, rf.me, args.Term, votes, len(voters))
+	return votes > len(voters)/2
+}
+
+// logWriterDaemon writes entries appended by Start() in batches,
+// so that concurrent proposals share a single persister write (group
+// commit). the leader fans a batch out to followers before writing it
+// locally, so disk and network latency overlap (Raft thesis 10.2.1);
+// it only counts itself toward the commit quorum once the write is done.
+func (rf *Raft) logWriterDaemon() {
+	for {
+		rf.mu.Lock()
+		for rf.persistedIndex == len(rf.Logs)-1 {
+			rf.flushCond.Wait()
+			select {
+			case <-rf.shutdownCh:
+				rf.mu.Unlock()
+				DPrintf("[%d-%s]: peer %d is shutting down log writer daemon.\n", rf.me, rf, rf.me)
+				return
+			default:
+			}
+		}
+		if rf.opts.BatchWait > 0 {
+			// let more proposals pile up
+			rf.mu.Unlock()
+			rf.clock.Sleep(rf.opts.BatchWait)
+			rf.mu.Lock()
+		}
+		if rf.persistedIndex == len(rf.Logs)-1 {
+			rf.mu.Unlock()
+			continue
+		}
+		from := rf.persistedIndex + 1
+		to := min(len(rf.Logs)-1, rf.persistedIndex+rf.opts.MaxBatchEntries)
+		entries := make([]LogEntry, to-from+1)
+		copy(entries, rf.Logs[from:to+1])
+		term := rf.CurrentTerm
+		if rf.state == Leader {
+			for i := 0; i < len(rf.peers); i++ {
+				if i != rf.me {
+					go rf.consistencyCheck(i)
+				}
+			}
+		}
+		// AppendEntries waits for this write before touching the log
+		rf.writing = true
+		rf.mu.Unlock()
+
+		rf.persister.SaveLogEntries(from-1, encodeEntries(entries))
+
+		rf.mu.Lock()
+		rf.writing = false
+		rf.persistedIndex = to
+		rf.writeCond.Broadcast()
+		DPrintf("[%d-%s]: peer %d wrote batch of %d entries (%d-%d).\n", rf.me, rf, rf.me, to-from+1, from, to)
+		if rf.state == Leader && rf.CurrentTerm == term {
+			rf.matchIndex[rf.me] = max(rf.matchIndex[rf.me], to)
+			rf.updateCommitIndex()
+		}
+		rf.mu.Unlock()
+	}
+}
+
 // applyLogEntryDaemon exit when shutdown channel is closed
 func (rf *Raft) applyLogEntryDaemon() {
 	for {
@@ -721,34 +1191,80 @@ func (rf *Raft) applyLogEntryDaemon() {
 			case <-rf.shutdownCh:
 				rf.mu.Unlock()
 				DPrintf("[%d-%s]: peer %d is shutting down apply log entry to client daemon.\n", rf.me, rf, rf.me)
-				close(rf.applyCh)
+				if rf.applyBatchCh != nil {
+					close(rf.applyBatchCh)
+				} else {
+					close(rf.applyCh)
+				}
 				return
 			default:
 			}
 		}
 		last, cur := rf.lastApplied, rf.commitIndex
+		var committed []int64
 		if last < cur {
 			rf.lastApplied = rf.commitIndex
 			logs = make([]LogEntry, cur-last)
 			copy(logs, rf.Logs[last+1:cur+1])
+			committed = rf.commitTimesOf(last+1, cur-last)
 		}
 		rf.mu.Unlock()
+		msgs := make([]ApplyMsg, cur-last)
 		for i := 0; i < cur-last; i++ {
 			// current command is replicated, ignore nil command
-			reply := ApplyMsg{
-				CommandIndex: last + i + 1,
-				Command:      logs[i].Command,
-				CommandValid: true,
-			}
+			msgs[i] = makeApplyMsg(last+i+1, logs[i], committed[i])
+		}
+		if rf.applyBatchCh != nil {
+			rf.applyBatches(msgs)
+			continue
+		}
+		for _, reply := range msgs {
 			// reply to outer service
 			// DPrintf("[%d-%s]: peer %d apply %v to client.\n", rf.me, rf, rf.me)
 			DPrintf("[%d-%s]: peer %d apply to client.\n", rf.me, rf, rf.me)
 			// Note: must in the same goroutine, or may result in out of order apply
 			rf.applyCh <- reply
+			atomic.StoreInt64(&rf.delivered, int64(reply.CommandIndex))
 		}
 	}
 }
 
+func makeApplyMsg(index int, entry LogEntry, committed int64) ApplyMsg {
+	m := ApplyMsg{
+		CommandIndex: index,
+		CommandValid: true,
+		Data:         entry.Data,
+		CommandTerm:  entry.Term,
+		CommandType:  entry.Type,
+		ProposeTime:  time.Unix(0, entry.ProposeTime),
+		CommitTime:   time.Unix(0, committed),
+	}
+	if entry.Type == EntryCommand {
+		m.Command = decodeCommand(entry.Data)
+	}
+	return m
+}
+
+// applyBatches sends msgs to the service in slices of at most
+// Options.MaxApplyBatch, in order. a message that is not a committed
+// entry (CommandValid false, e.g. a snapshot) always goes out in a
+// batch of its own, after every entry before it.
+func (rf *Raft) applyBatches(msgs []ApplyMsg) {
+	for len(msgs) > 0 {
+		n := 1
+		if msgs[0].CommandValid {
+			for n < len(msgs) && msgs[n].CommandValid &&
+				(rf.opts.MaxApplyBatch <= 0 || n < rf.opts.MaxApplyBatch) {
+				n++
+			}
+		}
+		DPrintf("[%d-%s]: peer %d apply batch of %d to client.\n", rf.me, rf, rf.me, n)
+		rf.applyBatchCh <- ApplyBatch{Entries: msgs[:n]}
+		atomic.StoreInt64(&rf.delivered, int64(msgs[n-1].CommandIndex))
+		msgs = msgs[n:]
+	}
+}
+
 //
 // the service or tester wants to create a Raft server. the ports
 // of all the Raft servers (including this one) are in peers[]. this
@@ -762,33 +1278,96 @@ func (rf *Raft) applyLogEntryDaemon() {
 //
 func Make(peers []*labrpc.ClientEnd, me int,
 	persister *Persister, applyCh chan ApplyMsg) *Raft {
+	return MakeWithOptions(peers, me, persister, applyCh, DefaultOptions())
+}
+
+// like Make(), but with tunables other than DefaultOptions().
+func MakeWithOptions(peers []*labrpc.ClientEnd, me int,
+	persister *Persister, applyCh chan ApplyMsg, opts Options) *Raft {
+	return MakeWithTransport(LabrpcPeers(peers), me, persister, applyCh, opts)
+}
+
+// like MakeBatchedWithTransport(), over labrpc.
+func MakeBatched(peers []*labrpc.ClientEnd, me int,
+	persister *Persister, applyCh chan ApplyBatch, opts Options) *Raft {
+	return MakeBatchedWithTransport(LabrpcPeers(peers), me, persister, applyCh, opts)
+}
+
+// like MakeWithOptions(), over any network, see transport.go.
+func MakeWithTransport(peers []Peer, me int,
+	persister *Persister, applyCh chan ApplyMsg, opts Options) *Raft {
+	return makeRaft(peers, me, persister, applyCh, nil, opts)
+}
+
+//
+// like MakeWithTransport(), but committed entries are sent on applyCh
+// in batches, up to Options.MaxApplyBatch entries each, rather than
+// one ApplyMsg at a time.
+//
+func MakeBatchedWithTransport(peers []Peer, me int,
+	persister *Persister, applyCh chan ApplyBatch, opts Options) *Raft {
+	return makeRaft(peers, me, persister, nil, applyCh, opts)
+}
+
+func makeRaft(peers []Peer, me int, persister *Persister,
+	applyCh chan ApplyMsg, applyBatchCh chan ApplyBatch, opts Options) *Raft {
 	rf := &Raft{}
 	rf.peers = peers
 	rf.persister = persister
 	rf.me = me
 	rf.applyCh = applyCh
+	rf.applyBatchCh = applyBatchCh
+	rf.opts = opts
+	rf.clock = opts.Clock
+	if rf.clock == nil {
+		rf.clock = labclock.Real
+	}
+	if rf.opts.MaxBatchEntries < 1 {
+		rf.opts.MaxBatchEntries = 1
+	}
 	// Your initialization code here (2A, 2B, 2C).
 	rf.state = Follower
 	rf.VotedFor = -1
 	rf.Logs = make([]LogEntry, 1) // first index is 1
 	rf.Logs[0] = LogEntry{        // placeholder
-		Term:    0,
-		Command: nil,
+		Term: 0,
+		Data: nil,
 	}
 	rf.nextIndex = make([]int, len(peers))
 	rf.matchIndex = make([]int, len(peers))
+	rf.leader = -1
+	rf.unreachable = make([]bool, len(peers))
+	rf.learner = make([]bool, len(peers))
+	rf.lastAck = make([]time.Time, len(peers))
+	rf.forwarding = make(map[int64]bool)
+	rf.forwardClient = newForwardClient()
+	rf.forwarded = make(map[int64]map[int64]forwarded)
+	for _, n := range opts.Learners {
+		rf.learner[n] = true
+	}
 
-	rf.electionTimeout = time.Millisecond * time.Duration(400+rand.Intn(100)*4)
-	rf.electionTimer = time.NewTimer(rf.electionTimeout)
+	// only makeRaft() and then electionDaemon() draw from it
+	seed := opts.Seed
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+	rf.rand = rand.New(rand.NewSource(seed + int64(me)))
+	rf.electionTimeout = rf.randomTimeout()
+	rf.electionTimer = rf.clock.NewTimer(rf.electionTimeout)
 	rf.resetTimer = make(chan struct{})
 	rf.shutdownCh = make(chan struct{})          // shutdown raft gracefully
 	rf.commitCond = sync.NewCond(&rf.mu)         // commitCh, a distinct goroutine
+	rf.flushCond = sync.NewCond(&rf.mu)          // wakes up the log writer
+	rf.writeCond = sync.NewCond(&rf.mu)          // log writer done writing
 	rf.heartbeatInterval = time.Millisecond * 40 // small enough, not too small
 
 	// initialize from state persisted before a crash
-	rf.readPersist(persister.ReadRaftState())
+	rf.readPersist(persister.ReadHardState(), persister.ReadLogEntries())
+	rf.updateConfig(1)
+	rf.observed = Event{Term: rf.CurrentTerm, State: rf.state, Leader: rf.leader}
 	go rf.electionDaemon()      // kick off election
 	go rf.applyLogEntryDaemon() // start apply log
+	go rf.logWriterDaemon()     // start group commit
 	DPrintf("[%d-%s]: newborn election(%s) heartbeat(%s) term(%d) voted(%d)\n",
 		rf.me, rf, rf.electionTimeout, rf.heartbeatInterval, rf.CurrentTerm, rf.VotedFor)
 	return rf
@@ -0,0 +1,57 @@
+package raft
+
+//
+// follower reads with bounded staleness, for queries that don't
+// need linearizability.
+//
+// applied, ok := rf.ReadableWithin(maxAge, maxLag)
+//   ok if the state the service has applied, up to index applied,
+//   is at most maxLag entries behind the leader's commit index as
+//   last heard, and that was at most maxAge ago. a leader measures
+//   age from the AEs a majority of voters last acknowledged.
+//
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// maxAge <= 0 or maxLag < 0 leaves that bound unchecked.
+func (rf *Raft) ReadableWithin(maxAge time.Duration, maxLag int) (int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	applied := int(atomic.LoadInt64(&rf.delivered))
+	commit, contact := rf.leaderCommit, rf.lastContact
+	if rf.state == Leader {
+		commit, contact = rf.commitIndex, rf.quorumContact()
+	}
+	if contact.IsZero() {
+		// never heard from a leader
+		return applied, false
+	}
+	if maxAge > 0 && rf.clock.Since(contact) > maxAge {
+		return applied, false
+	}
+	if maxLag >= 0 && commit-applied > maxLag {
+		return applied, false
+	}
+	return applied, true
+}
+
+// the latest time a majority of voters, the leader included, were
+// known to follow this leader. should be called when holding the lock
+func (rf *Raft) quorumContact() time.Time {
+	var acks []time.Time
+	for _, n := range rf.voters() {
+		if n == rf.me {
+			acks = append(acks, rf.clock.Now())
+		} else {
+			acks = append(acks, rf.lastAck[n])
+		}
+	}
+	// newest first, the majority-th newest is the one that counts
+	sort.Slice(acks, func(i, j int) bool { return acks[i].After(acks[j]) })
+	return acks[len(acks)/2]
+}
@@ -0,0 +1,78 @@
+package raft
+
+//
+// tailing the committed log, besides the applyCh handed to Make().
+//
+// ch, cancel, err := rf.Subscribe(fromIndex)
+//   replays the committed entries from fromIndex that are still in
+//   the log, then streams new commits as this peer learns of them.
+//   every subscriber has its own buffer, so a slow one only holds
+//   up itself. cancel() closes ch.
+//
+
+import (
+	"errors"
+	"sync"
+)
+
+// the entries asked for are no longer in the log.
+var ErrCompacted = errors.New("raft: requested index is compacted")
+
+func (rf *Raft) Subscribe(fromIndex int) (<-chan ApplyMsg, func(), error) {
+	// Logs[0] is a placeholder, the first entry kept is at index 1
+	if fromIndex < 1 {
+		return nil, nil, ErrCompacted
+	}
+
+	ch := make(chan ApplyMsg, rf.opts.SubscribeBuffer)
+	done := make(chan struct{})
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			rf.mu.Lock()
+			close(done)
+			rf.mu.Unlock()
+			// wake up the daemon if it waits for new commits
+			rf.commitCond.Broadcast()
+		})
+	}
+	go rf.subscriptionDaemon(fromIndex, ch, done)
+	return ch, cancel, nil
+}
+
+// subscriptionDaemon feeds one subscriber, exits when it's cancelled
+// or the shutdown channel is closed
+func (rf *Raft) subscriptionDaemon(next int, ch chan ApplyMsg, done chan struct{}) {
+	defer close(ch)
+	for {
+		rf.mu.Lock()
+		for next > rf.commitIndex {
+			select {
+			case <-done:
+				rf.mu.Unlock()
+				return
+			case <-rf.shutdownCh:
+				rf.mu.Unlock()
+				return
+			default:
+			}
+			rf.commitCond.Wait()
+		}
+		cur := rf.commitIndex
+		logs := make([]LogEntry, cur-next+1)
+		copy(logs, rf.Logs[next:cur+1])
+		committed := rf.commitTimesOf(next, len(logs))
+		rf.mu.Unlock()
+
+		for i, entry := range logs {
+			select {
+			case ch <- makeApplyMsg(next+i, entry, committed[i]):
+			case <-done:
+				return
+			case <-rf.shutdownCh:
+				return
+			}
+		}
+		next = cur + 1
+	}
+}
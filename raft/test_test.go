@@ -9,16 +9,24 @@ package raft
 //
 
 import "testing"
+import "flag"
 import "fmt"
 import "time"
-import "math/rand"
 import "sync/atomic"
 import "sync"
 
+import "6.824-lab/labrpc"
+import "6.824-lab/labclock"
+
 // The tester generously allows solutions to complete elections in one second
 // (much more than the paper's range of timeouts).
 const RaftElectionTimeout = 1000 * time.Millisecond
 
+func init() {
+	flag.Int64Var(&netSeed, "seed", 0, "seed labrpc's faults with this, to replay a failed run")
+	flag.BoolVar(&simTime, "simtime", false, "run in simulated time, see labclock")
+}
+
 func TestInitialElection2A(t *testing.T) {
 	servers := 3
 	cfg := make_config(t, servers, false)
@@ -31,14 +39,14 @@ func TestInitialElection2A(t *testing.T) {
 
 	// sleep a bit to avoid racing with followers learning of the
 	// election, then check that all peers agree on the term.
-	time.Sleep(50 * time.Millisecond)
+	cfg.clock.Sleep(50 * time.Millisecond)
 	term1 := cfg.checkTerms()
 	if term1 < 1 {
 		t.Fatalf("term is %v, but should be at least 1", term1)
 	}
 
 	// does the leader+term stay the same if there is no network failure?
-	time.Sleep(2 * RaftElectionTimeout)
+	cfg.clock.Sleep(2 * RaftElectionTimeout)
 	term2 := cfg.checkTerms()
 	if term1 != term2 {
 		fmt.Printf("warning: term changed even though there were no failures")
@@ -72,7 +80,7 @@ func TestReElection2A(t *testing.T) {
 	// be elected.
 	cfg.disconnect(leader2)
 	cfg.disconnect((leader2 + 1) % servers)
-	time.Sleep(2 * RaftElectionTimeout)
+	cfg.clock.Sleep(2 * RaftElectionTimeout)
 	cfg.checkNoLeader()
 
 	// if a quorum arises, it should elect a leader.
@@ -109,223 +117,1629 @@ func TestBasicAgree2B(t *testing.T) {
 	cfg.end()
 }
 
-//
-// check, based on counting bytes of RPCs, that
-// each command is sent to each peer just once.
-//
-func TestRPCBytes2B(t *testing.T) {
-	servers := 3
+//
+// check, based on counting bytes of RPCs, that
+// each command is sent to each peer just once.
+//
+func TestRPCBytes2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): RPC byte count")
+
+	cfg.one(99, servers, false)
+	bytes0 := cfg.bytesTotal()
+
+	iters := 10
+	var sent int64 = 0
+	for index := 2; index < iters+2; index++ {
+		cmd := randstring(5000)
+		xindex := cfg.one(cmd, servers, false)
+		if xindex != index {
+			t.Fatalf("got index %v but expected %v", xindex, index)
+		}
+		sent += int64(len(cmd))
+	}
+
+	bytes1 := cfg.bytesTotal()
+	got := bytes1 - bytes0
+	expected := int64(servers) * sent
+	if got > expected+30000 {
+		t.Fatalf("too many RPC bytes; got %v, expected %v", got, expected)
+	}
+
+	cfg.end()
+}
+
+func TestFailAgree2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): agreement despite follower disconnection")
+
+	cfg.one(101, servers, false)
+
+	// disconnect one follower from the network.
+	leader := cfg.checkOneLeader()
+	cfg.disconnect((leader + 1) % servers)
+
+	// the leader and remaining follower should be
+	// able to agree despite the disconnected follower.
+	cfg.one(102, servers-1, false)
+	cfg.one(103, servers-1, false)
+	cfg.clock.Sleep(RaftElectionTimeout)
+	cfg.one(104, servers-1, false)
+	cfg.one(105, servers-1, false)
+
+	// re-connect
+	cfg.connect((leader + 1) % servers)
+
+	// the full set of servers should preserve
+	// previous agreements, and be able to agree
+	// on new commands.
+	cfg.one(106, servers, true)
+	cfg.clock.Sleep(RaftElectionTimeout)
+	cfg.one(107, servers, true)
+
+	cfg.end()
+}
+
+func TestFailNoAgree2B(t *testing.T) {
+	servers := 5
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): no agreement if too many followers disconnect")
+
+	cfg.one(10, servers, false)
+
+	// 3 of 5 followers disconnect
+	leader := cfg.checkOneLeader()
+	cfg.disconnect((leader + 1) % servers)
+	cfg.disconnect((leader + 2) % servers)
+	cfg.disconnect((leader + 3) % servers)
+
+	index, _, ok := cfg.rafts[leader].Start(20)
+	if ok != true {
+		t.Fatalf("leader rejected Start()")
+	}
+	if index != 2 {
+		t.Fatalf("expected index 2, got %v", index)
+	}
+
+	cfg.clock.Sleep(2 * RaftElectionTimeout)
+
+	n, _ := cfg.nCommitted(index)
+	if n > 0 {
+		t.Fatalf("%v committed but no majority", n)
+	}
+
+	// repair
+	cfg.connect((leader + 1) % servers)
+	cfg.connect((leader + 2) % servers)
+	cfg.connect((leader + 3) % servers)
+
+	// the disconnected majority may have chosen a leader from
+	// among their own ranks, forgetting index 2.
+	leader2 := cfg.checkOneLeader()
+	index2, _, ok2 := cfg.rafts[leader2].Start(30)
+	if ok2 == false {
+		t.Fatalf("leader2 rejected Start()")
+	}
+	if index2 < 2 || index2 > 3 {
+		t.Fatalf("unexpected index %v", index2)
+	}
+
+	cfg.one(1000, servers, true)
+
+	cfg.end()
+}
+
+func TestConcurrentStarts2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): concurrent Start()s")
+
+	var success bool
+loop:
+	for try := 0; try < 5; try++ {
+		if try > 0 {
+			// give solution some time to settle
+			cfg.clock.Sleep(3 * time.Second)
+		}
+
+		leader := cfg.checkOneLeader()
+		_, term, ok := cfg.rafts[leader].Start(1)
+		if !ok {
+			// leader moved on really quickly
+			continue
+		}
+
+		iters := 5
+		var wg sync.WaitGroup
+		is := make(chan int, iters)
+		for ii := 0; ii < iters; ii++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				i, term1, ok := cfg.rafts[leader].Start(100 + i)
+				if term1 != term {
+					return
+				}
+				if ok != true {
+					return
+				}
+				is <- i
+			}(ii)
+		}
+
+		wg.Wait()
+		close(is)
+
+		for j := 0; j < servers; j++ {
+			if t, _ := cfg.rafts[j].GetState(); t != term {
+				// term changed -- can't expect low RPC counts
+				continue loop
+			}
+		}
+
+		failed := false
+		cmds := []int{}
+		for index := range is {
+			cmd := cfg.wait(index, servers, term)
+			if ix, ok := cmd.(int); ok {
+				if ix == -1 {
+					// peers have moved on to later terms
+					// so we can't expect all Start()s to
+					// have succeeded
+					failed = true
+					break
+				}
+				cmds = append(cmds, ix)
+			} else {
+				t.Fatalf("value %v is not an int", cmd)
+			}
+		}
+
+		if failed {
+			// avoid leaking goroutines
+			go func() {
+				for range is {
+				}
+			}()
+			continue
+		}
+
+		for ii := 0; ii < iters; ii++ {
+			x := 100 + ii
+			ok := false
+			for j := 0; j < len(cmds); j++ {
+				if cmds[j] == x {
+					ok = true
+				}
+			}
+			if ok == false {
+				t.Fatalf("cmd %v missing in %v", x, cmds)
+			}
+		}
+
+		success = true
+		break
+	}
+
+	if !success {
+		t.Fatalf("term changed too often")
+	}
+
+	cfg.end()
+}
+
+func TestGroupCommit2B(t *testing.T) {
+	servers := 3
+	opts := DefaultOptions()
+	opts.MaxBatchEntries = 4
+	opts.BatchWait = 10 * time.Millisecond
+	cfg := make_config_options(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): concurrent Start()s with group commit")
+
+	leader := cfg.checkOneLeader()
+	cfg.one(1, servers, true)
+
+	cfg.mu.Lock()
+	persister := cfg.saved[leader]
+	cfg.mu.Unlock()
+	writes0 := persister.LogWrites()
+
+	iters := 20
+	var wg sync.WaitGroup
+	is := make(chan int, iters)
+	for ii := 0; ii < iters; ii++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			index, _, ok := cfg.rafts[leader].Start(100 + i)
+			if ok {
+				is <- index
+			}
+		}(ii)
+	}
+	wg.Wait()
+	close(is)
+
+	if len(is) != iters {
+		t.Fatalf("leader %v accepted only %v of %v commands", leader, len(is), iters)
+	}
+	seen := map[int]bool{}
+	last := 0
+	for index := range is {
+		if seen[index] {
+			t.Fatalf("index %v handed out twice", index)
+		}
+		seen[index] = true
+		last = max(last, index)
+		cfg.wait(index, servers, -1)
+	}
+
+	// the followers alone make a majority, so the leader's own writes
+	// may still be going on.
+	for t1 := cfg.clock.Now(); len(persister.ReadLogEntries()) < last; {
+		if cfg.clock.Since(t1) > 2*time.Second {
+			t.Fatalf("leader %v didn't write entries up to %v", leader, last)
+		}
+		cfg.clock.Sleep(10 * time.Millisecond)
+	}
+	// concurrent proposals share log writes
+	if writes := persister.LogWrites() - writes0; writes >= iters {
+		t.Fatalf("leader %v wrote its log %v times for %v entries", leader, writes, iters)
+	}
+
+	cfg.end()
+}
+
+//
+// the leader replicates while its own log write is in flight, and
+// must not report an entry committed until a majority, counting
+// itself only after its write completes, has stored it.
+//
+func TestDurableBeforeCommit2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+	cfg.checkDurable = true
+
+	cfg.begin("Test (2B): entries committed only once durable on a majority")
+
+	cfg.one(101, servers, true)
+
+	// a slow leader disk: the followers form the majority.
+	leader := cfg.checkOneLeader()
+	latency := 2 * time.Second
+	cfg.saved[leader].SetLogLatency(latency)
+	t0 := cfg.clock.Now()
+	index, _, ok := cfg.rafts[leader].Start(102)
+	if !ok {
+		t.Fatalf("leader %v rejected Start()", leader)
+	}
+	cfg.wait(index, 1, -1)
+	if cfg.clock.Since(t0) >= latency {
+		t.Fatalf("commit waited for the leader's own write")
+	}
+	cfg.wait(index, servers, -1)
+	cfg.saved[leader].SetLogLatency(0)
+
+	// one follower gone: the leader's write is needed for a majority.
+	cfg.disconnect((leader + 1) % servers)
+	cfg.one(103, servers-1, true)
+	cfg.saved[leader].SetLogLatency(100 * time.Millisecond)
+	cfg.one(104, servers-1, true)
+	cfg.saved[leader].SetLogLatency(0)
+	cfg.connect((leader + 1) % servers)
+	cfg.one(105, servers, true)
+
+	cfg.end()
+}
+
+type typedPut struct {
+	Key   string
+	Value int
+}
+
+func TestTypedRaft2B(t *testing.T) {
+	servers := 3
+	// no Rafts of its own, just the network and clock
+	cfg := make_config(t, 0, false)
+	defer cfg.cleanup()
+	net := cfg.net
+
+	fmt.Printf("Test (2B): typed commands through TypedRaft ...\n")
+
+	rafts := make([]*TypedRaft[typedPut], servers)
+	applyChs := make([]chan TypedApplyMsg[typedPut], servers)
+	for i := 0; i < servers; i++ {
+		ends := make([]*labrpc.ClientEnd, servers)
+		for j := 0; j < servers; j++ {
+			endname := fmt.Sprintf("typed-%d-%d", i, j)
+			ends[j] = net.MakeEnd(endname)
+			net.Connect(endname, j)
+			net.Enable(endname, true)
+		}
+		applyChs[i] = make(chan TypedApplyMsg[typedPut], 10)
+		rafts[i] = MakeTyped[typedPut](ends, i, MakePersister(), applyChs[i], GobCodec[typedPut]{}, cfg.opts)
+		srv := labrpc.MakeServer()
+		srv.AddService(labrpc.MakeService(rafts[i].Raft))
+		net.AddServer(i, srv)
+	}
+	defer func() {
+		for i := 0; i < servers; i++ {
+			rafts[i].Kill()
+		}
+	}()
+
+	var index int
+	t0 := cfg.clock.Now()
+	for cfg.clock.Since(t0) < 5*time.Second {
+		for i := 0; i < servers; i++ {
+			if idx, _, err := rafts[i].Start(typedPut{"x", 42}); err == nil {
+				index = idx
+			}
+		}
+		if index > 0 {
+			break
+		}
+		cfg.clock.Sleep(50 * time.Millisecond)
+	}
+	if index != 1 {
+		t.Fatalf("got index %v but expected 1", index)
+	}
+
+	for i := 0; i < servers; i++ {
+		select {
+		case m := <-applyChs[i]:
+			if !m.CommandValid || m.CommandIndex != index || m.Command != (typedPut{"x", 42}) {
+				t.Fatalf("server %v applied %+v", i, m)
+			}
+		case <-cfg.clock.After(2 * RaftElectionTimeout):
+			t.Fatalf("server %v did not apply index %v", i, index)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestApplyMsgFields2B(t *testing.T) {
+	servers := 3
+	opts := DefaultOptions()
+	opts.NoopOnElection = true
+	cfg := make_config_options(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): term, type and timestamps in ApplyMsg")
+
+	var mu sync.Mutex
+	msgs := make([]map[int]ApplyMsg, servers)
+	for i := 0; i < servers; i++ {
+		msgs[i] = map[int]ApplyMsg{}
+	}
+	cfg.mu.Lock()
+	cfg.onApply = func(i int, m ApplyMsg) {
+		mu.Lock()
+		defer mu.Unlock()
+		msgs[i][m.CommandIndex] = m
+	}
+	cfg.mu.Unlock()
+	applied := func(i int, index int) ApplyMsg {
+		mu.Lock()
+		defer mu.Unlock()
+		return msgs[i][index]
+	}
+
+	// the first leader's no-op sits at index 1.
+	leader1 := cfg.checkOneLeader()
+	t0 := cfg.clock.Now()
+	index := cfg.one(101, servers, true)
+	if index != 2 {
+		t.Fatalf("got index %v but expected 2 after the leader's no-op", index)
+	}
+	term, _ := cfg.rafts[leader1].GetState()
+	m := applied(leader1, index)
+	if m.CommandTerm != term || m.CommandType != EntryCommand || m.Command != 101 {
+		t.Fatalf("leader applied %+v, expected command 101 in term %v", m, term)
+	}
+	if m.ProposeTime.Before(t0) || m.CommitTime.Before(m.ProposeTime) || cfg.clock.Now().Before(m.CommitTime) {
+		t.Fatalf("bad timestamps: proposed %v, committed %v", m.ProposeTime, m.CommitTime)
+	}
+
+	// a new leader commits a no-op in its own term.
+	cfg.disconnect(leader1)
+	leader2 := cfg.checkOneLeader()
+	index = cfg.one(102, servers-1, true)
+	term2, _ := cfg.rafts[leader2].GetState()
+	if m := applied(leader2, index-1); m.CommandType != EntryNoop || m.CommandTerm != term2 {
+		t.Fatalf("expected a no-op of term %v at index %v, got %+v", term2, index-1, m)
+	}
+	cfg.connect(leader1)
+	cfg.one(103, servers, true)
+
+	// an entry committed while the service is busy was committed
+	// then, not when the service got round to it.
+	leader3 := cfg.checkOneLeader()
+	busy := make(chan bool)
+	var free time.Time
+	cfg.mu.Lock()
+	cfg.onApply = func(i int, m ApplyMsg) {
+		if i == leader3 && m.Command == 104 {
+			close(busy)
+			cfg.clock.Sleep(RaftElectionTimeout)
+			mu.Lock()
+			free = cfg.clock.Now()
+			mu.Unlock()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		msgs[i][m.CommandIndex] = m
+	}
+	cfg.mu.Unlock()
+	cfg.one(104, servers, true)
+	<-busy
+	// 105 fills the hand-off to the service, 106 waits behind it.
+	cfg.one(105, servers-1, true)
+	index = cfg.one(106, servers-1, true)
+	for iters := 0; applied(leader3, index).Command != 106; iters++ {
+		if iters > 100 {
+			t.Fatalf("leader %v never applied index %v", leader3, index)
+		}
+		cfg.clock.Sleep(RaftElectionTimeout / 10)
+	}
+	mu.Lock()
+	m = msgs[leader3][index]
+	freed := free
+	mu.Unlock()
+	if !m.CommitTime.Before(freed) {
+		t.Fatalf("entry committed while the service was busy has CommitTime %v, after it was free at %v",
+			m.CommitTime, freed)
+	}
+
+	cfg.end()
+}
+
+func TestBackpressure2B(t *testing.T) {
+	servers := 3
+	opts := DefaultOptions()
+	opts.MaxUncommittedEntries = 5
+	opts.MaxUncommittedBytes = 3000
+	cfg := make_config_options(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): proposals dropped beyond uncommitted limits")
+
+	cfg.one(101, servers, true)
+	leader := cfg.checkOneLeader()
+	rf := cfg.rafts[leader]
+
+	// nothing commits without the followers.
+	cfg.disconnect((leader + 1) % servers)
+	cfg.disconnect((leader + 2) % servers)
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := rf.Propose(make([]byte, 1000)); err != nil {
+			t.Fatalf("proposal %v under the byte limit failed: %v", i, err)
+		}
+	}
+	if _, _, err := rf.Propose(make([]byte, 1000)); err != ErrProposalDropped {
+		t.Fatalf("expected ErrProposalDropped beyond the byte limit, got %v", err)
+	}
+
+	cfg.connect((leader + 1) % servers)
+	cfg.connect((leader + 2) % servers)
+	cfg.one(102, servers, true)
+
+	leader = cfg.checkOneLeader()
+	rf = cfg.rafts[leader]
+	cfg.disconnect((leader + 1) % servers)
+	cfg.disconnect((leader + 2) % servers)
+
+	for i := 0; i < 5; i++ {
+		if _, _, err := rf.Propose([]byte{byte(i)}); err != nil {
+			t.Fatalf("proposal %v under the entry limit failed: %v", i, err)
+		}
+	}
+	if _, _, ok := rf.Start(103); ok {
+		t.Fatalf("Start() accepted a command beyond the entry limit")
+	}
+
+	m := rf.Metrics()
+	if m.ProposalsDropped < 1 || m.DroppedUncommittedEntries < 1 {
+		t.Fatalf("metrics do not show the dropped proposals: %+v", m)
+	}
+
+	cfg.connect((leader + 1) % servers)
+	cfg.connect((leader + 2) % servers)
+	cfg.one(104, servers, true)
+
+	cfg.end()
+}
+
+func TestUnappliedBackpressure2B(t *testing.T) {
+	servers := 3
+	opts := DefaultOptions()
+	opts.MaxUnappliedEntries = 3
+	cfg := make_config_options(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): proposals dropped while the service lags")
+
+	cfg.one(101, servers, true)
+	leader := cfg.checkOneLeader()
+	rf := cfg.rafts[leader]
+
+	// the leader's service stops reading applyCh at its next entry.
+	hold := make(chan struct{})
+	cfg.mu.Lock()
+	cfg.onApply = func(i int, m ApplyMsg) {
+		if i == leader && m.CommandValid {
+			<-hold
+		}
+	}
+	cfg.mu.Unlock()
+
+	// entries still commit, but pile up unapplied at the leader.
+	dropped := false
+	for i := 0; i < 10 && !dropped; i++ {
+		index, _, err := rf.Propose([]byte{byte(i)})
+		if err == ErrProposalDropped {
+			dropped = true
+			break
+		}
+		if err != nil {
+			t.Fatalf("proposal %v failed: %v", i, err)
+		}
+		for t0 := cfg.clock.Now(); ; cfg.clock.Sleep(10 * time.Millisecond) {
+			rf.mu.Lock()
+			committed := rf.commitIndex >= index
+			rf.mu.Unlock()
+			if committed {
+				break
+			}
+			if cfg.clock.Since(t0) > 10*time.Second {
+				t.Fatalf("index %v not committed", index)
+			}
+		}
+	}
+	if !dropped {
+		t.Fatalf("expected ErrProposalDropped with the applyCh reader blocked")
+	}
+	if m := rf.Metrics(); m.DroppedUnappliedEntries < 1 {
+		t.Fatalf("metrics do not show the dropped proposal: %+v", m)
+	}
+
+	// once the service catches up, proposals go through again.
+	cfg.mu.Lock()
+	cfg.onApply = nil
+	cfg.mu.Unlock()
+	close(hold)
+	cfg.one(102, servers, true)
+
+	cfg.end()
+}
+
+func TestBatchedApply2B(t *testing.T) {
+	servers := 3
+	opts := DefaultOptions()
+	opts.MaxApplyBatch = 3
+	opts.BatchWait = 5 * time.Millisecond
+	cfg := make_config_options(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): batched delivery on applyCh")
+
+	// re-start everyone with MakeBatched().
+	cfg.batchApply = true
+	for i := 0; i < servers; i++ {
+		cfg.start1(i)
+	}
+	for i := 0; i < servers; i++ {
+		cfg.disconnect(i)
+		cfg.connect(i)
+	}
+
+	cfg.one(101, servers, true)
+	leader := cfg.checkOneLeader()
+
+	// hold every server's applier until the proposals below have
+	// committed, so the backlog is delivered in full batches.
+	var mu sync.Mutex
+	sizes := []int{}
+	hold := make(chan struct{})
+	cfg.mu.Lock()
+	cfg.onBatch = func(i int, b ApplyBatch) {
+		<-hold
+		mu.Lock()
+		sizes = append(sizes, len(b.Entries))
+		mu.Unlock()
+	}
+	cfg.mu.Unlock()
+
+	// concurrent proposals commit together and are applied in batches;
+	// the applyCh readers check that indices arrive in order.
+	iters := 20
+	var wg sync.WaitGroup
+	last := 0
+	for ii := 0; ii < iters; ii++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			index, _, ok := cfg.rafts[leader].Start(200 + i)
+			if ok {
+				mu.Lock()
+				last = max(last, index)
+				mu.Unlock()
+			}
+		}(ii)
+	}
+	wg.Wait()
+	rf := cfg.rafts[leader]
+	for t0 := cfg.clock.Now(); ; cfg.clock.Sleep(10 * time.Millisecond) {
+		rf.mu.Lock()
+		committed := rf.commitIndex >= last
+		rf.mu.Unlock()
+		if committed {
+			break
+		}
+		if cfg.clock.Since(t0) > 10*time.Second {
+			t.Fatalf("index %v not committed", last)
+		}
+	}
+	close(hold)
+	cfg.one(301, servers, true)
+
+	mu.Lock()
+	biggest := 0
+	for _, n := range sizes {
+		if n > opts.MaxApplyBatch {
+			t.Fatalf("batch of %v entries, MaxApplyBatch is %v", n, opts.MaxApplyBatch)
+		}
+		biggest = max(biggest, n)
+	}
+	mu.Unlock()
+	if biggest < 2 {
+		t.Fatalf("no batch had more than one entry")
+	}
+
+	cfg.end()
+}
+
+func TestSubscribe2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): subscribers replay and tail the committed log")
+
+	for i := 1; i <= 3; i++ {
+		cfg.one(100+i, servers, true)
+	}
+
+	if _, _, err := cfg.rafts[0].Subscribe(0); err != ErrCompacted {
+		t.Fatalf("Subscribe(0) returned %v, expected ErrCompacted", err)
+	}
+
+	expect := func(ch <-chan ApplyMsg, index int, cmd int) {
+		select {
+		case m := <-ch:
+			if m.CommandIndex != index || m.Command != cmd {
+				t.Fatalf("subscriber got %v at index %v, expected %v at %v",
+					m.Command, m.CommandIndex, cmd, index)
+			}
+		case <-cfg.clock.After(2 * RaftElectionTimeout):
+			t.Fatalf("subscriber got nothing for index %v", index)
+		}
+	}
+
+	// a follower replays from the middle of the log, then tails it.
+	follower := (cfg.checkOneLeader() + 1) % servers
+	ch, cancel, err := cfg.rafts[follower].Subscribe(2)
+	if err != nil {
+		t.Fatalf("Subscribe(2) failed: %v", err)
+	}
+	expect(ch, 2, 102)
+	expect(ch, 3, 103)
+	cfg.one(104, servers, true)
+	expect(ch, 4, 104)
+
+	cancel()
+	for range ch {
+	}
+	cancel()
+
+	cfg.end()
+}
+
+func TestEntriesDigest2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): read committed entries and compare digests")
+
+	for i := 1; i <= 5; i++ {
+		cfg.one(100+i, servers, true)
+	}
+
+	if _, err := cfg.rafts[0].Entries(0, 6, 0); err != ErrCompacted {
+		t.Fatalf("Entries(0, ...) returned %v, expected ErrCompacted", err)
+	}
+
+	var digests []uint64
+	for i := 0; i < servers; i++ {
+		entries, err := cfg.rafts[i].Entries(1, 100, 0)
+		if err != nil {
+			t.Fatalf("Entries() failed on %v: %v", i, err)
+		}
+		if len(entries) != 5 {
+			t.Fatalf("server %v returned %v committed entries, expected 5", i, len(entries))
+		}
+		for j, entry := range entries {
+			if entry.Term < 1 || decodeCommand(entry.Data) != 101+j {
+				t.Fatalf("server %v entry %v is %v in term %v",
+					i, j+1, decodeCommand(entry.Data), entry.Term)
+			}
+		}
+		if small, _ := cfg.rafts[i].Entries(1, 6, 1); len(small) != 1 {
+			t.Fatalf("Entries() with maxBytes=1 returned %v entries, expected 1", len(small))
+		}
+
+		d, err := cfg.rafts[i].LogDigest(5)
+		if err != nil {
+			t.Fatalf("LogDigest(5) failed on %v: %v", i, err)
+		}
+		digests = append(digests, d)
+	}
+	for i := 1; i < servers; i++ {
+		if digests[i] != digests[0] {
+			t.Fatalf("servers 0 and %v disagree on the digest of a committed prefix", i)
+		}
+	}
+
+	if d, _ := cfg.rafts[0].LogDigest(4); d == digests[0] {
+		t.Fatalf("digests of different prefixes are equal")
+	}
+	if _, err := cfg.rafts[0].LogDigest(6); err != ErrUncommitted {
+		t.Fatalf("LogDigest(6) returned %v, expected ErrUncommitted", err)
+	}
+
+	// scribbling on what Entries() returned leaves the log alone.
+	cfg.one(106, servers, true)
+	entries, _ := cfg.rafts[0].Entries(6, 7, 0)
+	for i := range entries[0].Data {
+		entries[0].Data[i] ^= 0xff
+	}
+	if again, _ := cfg.rafts[0].Entries(6, 7, 0); decodeCommand(again[0].Data) != 106 {
+		t.Fatalf("changing Entries()' result changed the log")
+	}
+	d0, _ := cfg.rafts[0].LogDigest(6)
+	d1, _ := cfg.rafts[1].LogDigest(6)
+	if d0 != d1 {
+		t.Fatalf("changing Entries()' result changed the digest")
+	}
+
+	cfg.end()
+}
+
+func TestObserver2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): observers see role, term, leader and peer changes")
+
+	chs := make([]<-chan Event, servers)
+	for i := 0; i < servers; i++ {
+		ch, cancel := cfg.rafts[i].Observe()
+		defer cancel()
+		chs[i] = ch
+	}
+
+	// wait for an event matching ok on server i's channel.
+	await := func(i int, what string, ok func(Event) bool) Event {
+		timeout := cfg.clock.After(4 * RaftElectionTimeout)
+		for {
+			select {
+			case ev := <-chs[i]:
+				if ok(ev) {
+					return ev
+				}
+			case <-timeout:
+				t.Fatalf("server %v saw no event for %v", i, what)
+			}
+		}
+	}
+
+	leader1 := cfg.checkOneLeader()
+	term1, _ := cfg.rafts[leader1].GetState()
+	await(leader1, "becoming leader", func(ev Event) bool {
+		return ev.Kind == EventState && ev.State == Leader && ev.Leader == leader1 && ev.Term == term1
+	})
+	for i := 0; i < servers; i++ {
+		if i != leader1 {
+			await(i, "learning of the leader", func(ev Event) bool {
+				return ev.Kind == EventLeader && ev.Leader == leader1 && ev.Term == term1
+			})
+		}
+	}
+
+	// the leader loses its followers, and they elect another.
+	cfg.disconnect(leader1)
+	other := (leader1 + 1) % servers
+	await(leader1, "an unreachable peer", func(ev Event) bool {
+		return ev.Kind == EventPeer && ev.Peer == other && !ev.Reachable
+	})
+	cfg.checkOneLeader()
+	await(other, "a new term", func(ev Event) bool {
+		return ev.Kind == EventTerm && ev.Term > term1
+	})
+
+	// the old leader comes back and steps down.
+	cfg.connect(leader1)
+	await(leader1, "stepping down", func(ev Event) bool {
+		return ev.Kind == EventState && ev.State == Follower && ev.Term > term1
+	})
+	// it may not be leader2 by now, but it is a leader of a later term.
+	await(leader1, "a new leader", func(ev Event) bool {
+		return ev.Kind == EventLeader && ev.Leader != -1 && ev.Term > term1
+	})
+
+	cfg.end()
+}
+
+// an observer that stops reading doesn't hold on to every event.
+func TestObserverQueue2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): an observer that falls behind")
+
+	rf := cfg.rafts[0]
+	ch, cancel := rf.Observe()
+	defer cancel()
+
+	// queue more events than the observer may hold, alternating
+	// reachability so that every call emits.
+	rf.mu.Lock()
+	for i := 0; i < 1000; i++ {
+		rf.noteReachable(1, i%2 == 1)
+		rf.emit(EventTerm)
+	}
+	n := len(rf.observers[len(rf.observers)-1].queue)
+	rf.mu.Unlock()
+	if n > maxObserverQueue+servers {
+		t.Fatalf("observer queue holds %v events", n)
+	}
+
+	// the latest of each is still delivered.
+	peer, term := false, false
+	timeout := cfg.clock.After(RaftElectionTimeout)
+	for !peer || !term {
+		select {
+		case ev := <-ch:
+			if ev.Kind == EventPeer && ev.Peer == 1 {
+				peer = ev.Reachable
+			}
+			if ev.Kind == EventTerm {
+				term = true
+			}
+		case <-timeout:
+			t.Fatalf("missed the latest events, peer %v term %v", peer, term)
+		}
+	}
+
+	cfg.end()
+}
+
+func TestLearner2B(t *testing.T) {
+	servers := 5
+	opts := DefaultOptions()
+	opts.Learners = []int{3, 4}
+	cfg := make_config_options(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): learners replicate without voting, then get promoted")
+
+	// only voters lead, learners still get every entry.
+	leader := cfg.checkOneLeader()
+	if leader >= 3 {
+		t.Fatalf("learner %v became leader", leader)
+	}
+	cfg.one(101, servers, true)
+
+	// the leader and both learners are not a majority.
+	v1, v2 := (leader+1)%3, (leader+2)%3
+	cfg.disconnect(v1)
+	cfg.disconnect(v2)
+	index, _, ok := cfg.rafts[leader].Start(102)
+	if !ok {
+		t.Fatalf("leader rejected Start()")
+	}
+	cfg.clock.Sleep(2 * RaftElectionTimeout)
+	if n, _ := cfg.nCommitted(index); n > 0 {
+		t.Fatalf("%v committed without a majority of voters", n)
+	}
+
+	// learners alone never elect anyone.
+	cfg.disconnect(leader)
+	cfg.clock.Sleep(2 * RaftElectionTimeout)
+	cfg.checkNoLeader()
+
+	cfg.connect(leader)
+	cfg.connect(v1)
+	cfg.connect(v2)
+	leader = cfg.checkOneLeader()
+	cfg.one(103, servers, true)
+
+	if _, _, err := cfg.rafts[leader].Promote(v1); err != ErrNotLearner {
+		t.Fatalf("promoting voter %v returned %v, expected ErrNotLearner", v1, err)
+	}
+	cfg.disconnect(4)
+	for i := 0; i < 5; i++ {
+		cfg.one(104+i, servers-1, true)
+	}
+	if _, _, err := cfg.rafts[leader].Promote(4); err != ErrLearnerBehind {
+		t.Fatalf("promoting a lagging learner returned %v, expected ErrLearnerBehind", err)
+	}
+
+	index, _, err := cfg.rafts[leader].Promote(3)
+	if err != nil {
+		t.Fatalf("Promote(3) failed: %v", err)
+	}
+	cfg.wait(index, servers-1, -1)
+	cfg.rafts[3].mu.Lock()
+	state := cfg.rafts[3].state
+	cfg.rafts[3].mu.Unlock()
+	if state != Follower {
+		t.Fatalf("promoted learner is in state %v, expected follower", state)
+	}
+
+	// four voters now, the leader needs two of the others: 3 and one more.
+	v1, v2 = -1, -1
+	for i := 0; i < 3; i++ {
+		if i != leader {
+			if v1 == -1 {
+				v1 = i
+			} else {
+				v2 = i
+			}
+		}
+	}
+	cfg.disconnect(v1)
+	cfg.one(110, 3, true)
+	cfg.disconnect(v2)
+	index, _, ok = cfg.rafts[leader].Start(111)
+	if !ok {
+		t.Fatalf("leader rejected Start()")
+	}
+	cfg.clock.Sleep(2 * RaftElectionTimeout)
+	if n, _ := cfg.nCommitted(index); n > 0 {
+		t.Fatalf("%v committed with 2 of 4 voters", n)
+	}
+
+	cfg.end()
+}
+
+func TestFollowerRead2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): follower reads within a staleness bound")
+
+	index := 0
+	for i := 1; i <= 3; i++ {
+		index = cfg.one(100+i, servers, true)
+	}
+
+	leader := cfg.checkOneLeader()
+	follower := (leader + 1) % servers
+	readable := func(i int, maxAge time.Duration, maxLag int) bool {
+		applied, ok := cfg.rafts[i].ReadableWithin(maxAge, maxLag)
+		if ok && maxLag == 0 && applied < index {
+			t.Fatalf("server %v readable at %v, behind %v", i, applied, index)
+		}
+		return ok
+	}
+	// applyCh delivery is counted just after the tester reads it.
+	eventually := func(i int, maxAge time.Duration, maxLag int) bool {
+		for iters := 0; iters < 20; iters++ {
+			if readable(i, maxAge, maxLag) {
+				return true
+			}
+			cfg.clock.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	for i := 0; i < servers; i++ {
+		if !eventually(i, RaftElectionTimeout, 0) {
+			t.Fatalf("server %v is not readable while caught up", i)
+		}
+	}
+
+	// a cut off follower falls behind the time bound, not the index
+	// bound: it can't know what it misses.
+	cfg.disconnect(follower)
+	index = cfg.one(104, servers-1, true)
+	cfg.clock.Sleep(RaftElectionTimeout)
+	if readable(follower, RaftElectionTimeout/2, -1) {
+		t.Fatalf("disconnected follower is readable")
+	}
+	if !eventually(follower, 0, 1) {
+		t.Fatalf("disconnected follower lags more than it knows of")
+	}
+
+	cfg.connect(follower)
+	index = cfg.one(105, servers, true)
+	leader = cfg.checkOneLeader()
+	if !eventually(follower, RaftElectionTimeout, 0) {
+		t.Fatalf("reconnected follower is not readable")
+	}
+
+	// neither is a leader cut off from its followers.
+	cfg.disconnect(leader)
+	cfg.clock.Sleep(RaftElectionTimeout)
+	if readable(leader, RaftElectionTimeout/2, -1) {
+		t.Fatalf("disconnected leader is readable")
+	}
+	cfg.connect(leader)
+
+	cfg.end()
+}
+
+func TestForward2B(t *testing.T) {
+	servers := 3
+	opts := DefaultOptions()
+	opts.ForwardProposals = true
+	cfg := make_config_options(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): followers forward proposals to the leader")
+
+	cfg.one(101, servers, true)
+	leader := cfg.checkOneLeader()
+	follower := (leader + 1) % servers
+
+	// cfg.one() may have forwarded through this follower already
+	before := cfg.rafts[follower].Metrics().ProposalsForwarded
+	index, term, ok := cfg.rafts[follower].Start(102)
+	if !ok {
+		t.Fatalf("follower did not forward Start()")
+	}
+	if lterm, _ := cfg.rafts[leader].GetState(); term != lterm {
+		t.Fatalf("forwarded entry got term %v, leader is in %v", term, lterm)
+	}
+	if cmd := cfg.wait(index, servers, term); cmd != 102 {
+		t.Fatalf("index %v committed %v, expected 102", index, cmd)
+	}
+	if n := cfg.rafts[follower].Metrics().ProposalsForwarded - before; n != 1 {
+		t.Fatalf("follower counted %v more forwarded proposals, expected 1", n)
+	}
+
+	// a retried RPC is answered from the first attempt.
+	args := ForwardArgs{Term: term, From: follower, Seq: 1000, Type: EntryCommand, Data: encodeCommand(103)}
+	var reply1, reply2 ForwardReply
+	cfg.rafts[leader].Forward(&args, &reply1)
+	cfg.rafts[leader].Forward(&args, &reply2)
+	if reply1.WrongLeader || reply1 != reply2 {
+		t.Fatalf("retried Forward() got %+v, first %+v", reply2, reply1)
+	}
+	cfg.wait(reply1.Index, servers, term)
+	if n, _ := cfg.nCommitted(reply1.Index + 1); n > 0 {
+		t.Fatalf("retried Forward() appended twice")
+	}
+
+	// a follower still in an older term is turned away.
+	rf := cfg.rafts[leader]
+	rf.mu.Lock()
+	last := len(rf.Logs) - 1
+	rf.mu.Unlock()
+	stale := ForwardArgs{Term: term - 1, From: follower, Seq: 1001, Type: EntryCommand, Data: encodeCommand(105)}
+	var reply3 ForwardReply
+	rf.Forward(&stale, &reply3)
+	rf.mu.Lock()
+	appended := len(rf.Logs) - 1 - last
+	rf.mu.Unlock()
+	if !reply3.WrongLeader || appended != 0 {
+		t.Fatalf("Forward() from term %v got %+v, appended %v entries", term-1, reply3, appended)
+	}
+
+	// and so is anything but a command.
+	conf := ForwardArgs{Term: term, From: follower, Seq: 1002, Type: EntryConfChange, Data: []byte{1}}
+	var reply4 ForwardReply
+	rf.Forward(&conf, &reply4)
+	rf.mu.Lock()
+	appended = len(rf.Logs) - 1 - last
+	rf.mu.Unlock()
+	if !reply4.WrongLeader || appended != 0 {
+		t.Fatalf("forwarded EntryConfChange got %+v, appended %v entries", reply4, appended)
+	}
+
+	// with no leader to forward to, it fails like a follower would.
+	cfg.disconnect(leader)
+	cfg.disconnect((leader + 2) % servers)
+	cfg.clock.Sleep(2 * RaftElectionTimeout)
+	if _, _, ok := cfg.rafts[follower].Start(104); ok {
+		t.Fatalf("Start() succeeded with no leader")
+	}
+
+	cfg.end()
+}
+
+// a restarted follower's Seqs start over, and must not be taken
+// for the ones it forwarded before.
+func TestForwardRestart2B(t *testing.T) {
+	servers := 3
+	opts := DefaultOptions()
+	opts.ForwardProposals = true
+	cfg := make_config_options(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): forwarding from a restarted follower")
+
+	cfg.one(101, servers, true)
+	leader := cfg.checkOneLeader()
+	follower := (leader + 1) % servers
+
+	// forward through the follower until it has, whatever one()
+	// sent through it already.
+	propose := func(cmd int) {
+		for iters := 0; iters < 50; iters++ {
+			cfg.mu.Lock()
+			rf := cfg.rafts[follower]
+			cfg.mu.Unlock()
+			index, term, ok := rf.Start(cmd)
+			if ok {
+				if got := cfg.wait(index, servers, term); got != cmd {
+					t.Fatalf("forwarded %v, but index %v committed %v", cmd, index, got)
+				}
+				return
+			}
+			// no leader known yet
+			cfg.clock.Sleep(RaftElectionTimeout / 10)
+		}
+		t.Fatalf("follower %v never forwarded %v", follower, cmd)
+	}
+	propose(102)
+
+	cfg.start1(follower)
+	cfg.connect(follower)
+	for cmd := 103; cmd < 106; cmd++ {
+		propose(cmd)
+	}
+
+	cfg.end()
+}
+
+func TestPriority2B(t *testing.T) {
+	servers := 3
+	opts := DefaultOptions()
+	opts.Priorities = []int{1, 1, 2}
+	cfg := make_config_options(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): leadership goes to, and returns to, the preferred peer")
+
+	// wait for peer 2 to lead, handing off to it if need be.
+	awaitPreferred := func() {
+		for iters := 0; iters < 20; iters++ {
+			if cfg.checkOneLeader() == 2 {
+				return
+			}
+			cfg.clock.Sleep(RaftElectionTimeout / 4)
+		}
+		t.Fatalf("preferred peer 2 did not become leader")
+	}
+
+	cfg.one(101, servers, true)
+	awaitPreferred()
+
+	// without it, another peer leads for a while.
+	cfg.disconnect(2)
+	for i := 0; i < 5; i++ {
+		cfg.one(102+i, servers-1, true)
+	}
+	if cfg.checkOneLeader() == 2 {
+		t.Fatalf("disconnected peer is the only leader")
+	}
+
+	// once back and caught up, it gets leadership back, with
+	// every entry committed in its absence.
+	cfg.connect(2)
+	cfg.one(107, servers, true)
+	awaitPreferred()
+	cfg.one(108, servers, true)
+
+	cfg.end()
+}
+
+func TestPriorityUnderLoad2B(t *testing.T) {
+	servers := 3
+	opts := DefaultOptions()
+	opts.Priorities = []int{1, 1, 2}
+	cfg := make_config_options(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): leadership goes to the preferred peer under load")
+
+	// another peer leads while the preferred one is down. crashed,
+	// rather than cut off, it doesn't come back with a higher term
+	// and simply win an election.
+	cfg.one(101, servers, true)
+	cfg.crash1(2)
+	cfg.one(102, servers-1, true)
+	leader := cfg.checkOneLeader()
+
+	// proposals never stop, and replication takes a while, so the
+	// preferred peer is only ever caught up if the leader pauses them.
+	// a slow TimeoutNow too, so proposals do run into the pause.
+	slow := &labrpc.FaultProfile{Latency: labrpc.Constant(10 * time.Millisecond)}
+	cfg.net.SetFaultProfile(nil, "Raft.AppendEntries", slow)
+	cfg.net.SetFaultProfile(nil, "Raft.TimeoutNow", slow)
+	var stop int32
+	var wg sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; atomic.LoadInt32(&stop) == 0; i++ {
+				for j := 0; j < servers; j++ {
+					cfg.mu.Lock()
+					rf := cfg.rafts[j]
+					cfg.mu.Unlock()
+					if rf != nil {
+						rf.Start(1000 + 100*i + p)
+					}
+				}
+				cfg.clock.Sleep(time.Millisecond)
+			}
+		}(p)
+	}
+
+	cfg.start1(2)
+	cfg.connect(2)
+	for iters := 0; ; iters++ {
+		if iters >= 40 {
+			t.Fatalf("preferred peer 2 did not take over under load")
+		}
+		cfg.clock.Sleep(RaftElectionTimeout / 4)
+		if cfg.checkOneLeader() == 2 {
+			break
+		}
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	if m := cfg.rafts[leader].Metrics(); m.DroppedHandOff < 1 {
+		t.Fatalf("old leader didn't pause proposals to hand off: %+v", m)
+	}
+	cfg.one(103, servers, true)
+
+	cfg.end()
+}
+
+func TestLeaderStickiness2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): followers of a live leader ignore RequestVote")
+
+	cfg.one(101, servers, true)
+	leader := cfg.checkOneLeader()
+	follower := (leader + 1) % servers
+	candidate := (leader + 2) % servers
+
+	term, _ := cfg.rafts[follower].GetState()
+	args := RequestVoteArgs{
+		Term:         term + 5,
+		CandidateID:  candidate,
+		LastLogIndex: 100,
+		LastLogTerm:  term + 4,
+	}
+	var reply RequestVoteReply
+	cfg.rafts[follower].RequestVote(&args, &reply)
+	if reply.VoteGranted {
+		t.Fatalf("follower of a live leader granted its vote")
+	}
+	if now, _ := cfg.rafts[follower].GetState(); now != term {
+		t.Fatalf("follower moved from term %v to %v", term, now)
+	}
+	if l := cfg.checkOneLeader(); l != leader {
+		t.Fatalf("leader changed from %v to %v", leader, l)
+	}
+
+	// a leadership transfer goes through all the same.
+	args.Transfer = true
+	cfg.rafts[follower].RequestVote(&args, &reply)
+	if !reply.VoteGranted {
+		t.Fatalf("follower turned down a transfer")
+	}
+	if now, _ := cfg.rafts[follower].GetState(); now != term+5 {
+		t.Fatalf("follower is in term %v, expected %v", now, term+5)
+	}
+
+	cfg.one(102, servers, true)
+
+	cfg.end()
+}
+
+func TestFlappingFollower2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): a follower back from a partition doesn't depose the leader")
+
+	cfg.one(101, servers, true)
+	leader := cfg.checkOneLeader()
+	term, _ := cfg.rafts[leader].GetState()
+	follower := (leader + 1) % servers
+
+	// cut off, its elections fail their pre-vote, so its term
+	// stays put, and its replies can't push the leader out.
+	cfg.disconnect(follower)
+	cfg.one(102, servers-1, true)
+	cfg.clock.Sleep(5 * RaftElectionTimeout)
+	if now, _ := cfg.rafts[follower].GetState(); now != term {
+		t.Fatalf("cut-off follower moved from term %v to %v", term, now)
+	}
+
+	cfg.connect(follower)
+	cfg.one(103, servers, true)
+	cfg.clock.Sleep(RaftElectionTimeout)
+	if l := cfg.checkOneLeader(); l != leader {
+		t.Fatalf("leader changed from %v to %v", leader, l)
+	}
+	if now, _ := cfg.rafts[leader].GetState(); now != term {
+		t.Fatalf("leader moved from term %v to %v", term, now)
+	}
+
+	cfg.end()
+}
+
+// a Peer that counts the RPCs going through it.
+type countingPeer struct {
+	Peer
+	calls *int64
+}
+
+func (p countingPeer) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) bool {
+	atomic.AddInt64(p.calls, 1)
+	return p.Peer.RequestVote(args, reply)
+}
+
+func (p countingPeer) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) bool {
+	atomic.AddInt64(p.calls, 1)
+	return p.Peer.AppendEntries(args, reply)
+}
+
+func TestTransport2B(t *testing.T) {
+	servers := 3
+	fmt.Printf("Test (2B): Raft over a Transport other than labrpc's ClientEnd ...\n")
+
+	// no Rafts of its own, just the network and clock
+	cfg := make_config(t, 0, false)
+	defer cfg.cleanup()
+	net := cfg.net
+	var calls int64
+	rafts := make([]*Raft, servers)
+	applyChs := make([]chan ApplyMsg, servers)
+	for i := 0; i < servers; i++ {
+		peers := make([]Peer, servers)
+		for j := 0; j < servers; j++ {
+			name := fmt.Sprintf("%v-%v", i, j)
+			end := net.MakeEnd(name)
+			net.Connect(name, j)
+			net.Enable(name, true)
+			peers[j] = countingPeer{LabrpcPeers([]*labrpc.ClientEnd{end})[0], &calls}
+		}
+		applyChs[i] = make(chan ApplyMsg, 10)
+		rafts[i] = MakeWithTransport(peers, i, MakePersister(), applyChs[i], cfg.opts)
+		srv := labrpc.MakeServer()
+		srv.AddService(labrpc.MakeService(rafts[i]))
+		net.AddServer(i, srv)
+	}
+	defer func() {
+		for _, rf := range rafts {
+			rf.Kill()
+		}
+	}()
+
+	var index int
+	for iters := 0; iters < 50; iters++ {
+		for i := 0; i < servers; i++ {
+			if idx, _, ok := rafts[i].Start(101); ok {
+				index = idx
+			}
+		}
+		if index > 0 {
+			break
+		}
+		cfg.clock.Sleep(RaftElectionTimeout / 10)
+	}
+	if index == 0 {
+		t.Fatalf("no leader")
+	}
+	for i := 0; i < servers; i++ {
+		select {
+		case m := <-applyChs[i]:
+			if m.CommandIndex != index || m.Command != 101 {
+				t.Fatalf("server %v applied %v at %v, expected 101 at %v", i, m.Command, m.CommandIndex, index)
+			}
+		case <-cfg.clock.After(2 * RaftElectionTimeout):
+			t.Fatalf("server %v applied nothing", i)
+		}
+	}
+	if atomic.LoadInt64(&calls) == 0 {
+		t.Fatalf("no RPC went through the Peers")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPartition2B(t *testing.T) {
+	servers := 5
 	cfg := make_config(t, servers, false)
 	defer cfg.cleanup()
 
-	cfg.begin("Test (2B): RPC byte count")
+	cfg.begin("Test (2B): leader in a minority partition")
 
-	cfg.one(99, servers, false)
-	bytes0 := cfg.bytesTotal()
+	cfg.one(101, servers, false)
 
-	iters := 10
-	var sent int64 = 0
-	for index := 2; index < iters+2; index++ {
-		cmd := randstring(5000)
-		xindex := cfg.one(cmd, servers, false)
-		if xindex != index {
-			t.Fatalf("got index %v but expected %v", xindex, index)
+	// the leader and one follower on one side, the rest on the other.
+	leader1 := cfg.checkOneLeader()
+	other := (leader1 + 1) % servers
+	var majority []int
+	for i := 0; i < servers; i++ {
+		if i != leader1 && i != other {
+			majority = append(majority, i)
 		}
-		sent += int64(len(cmd))
+	}
+	cfg.partition([]int{leader1, other}, majority)
+	if cfg.net.Reachable(leader1, majority[0]) || !cfg.net.Reachable(leader1, other) {
+		t.Fatalf("topology %v doesn't match the partition", cfg.net.Topology())
 	}
 
-	bytes1 := cfg.bytesTotal()
-	got := bytes1 - bytes0
-	expected := int64(servers) * sent
-	if got > expected+30000 {
-		t.Fatalf("too many RPC bytes; got %v, expected %v", got, expected)
+	// the minority can't commit.
+	index, _, ok := cfg.rafts[leader1].Start(102)
+	if !ok {
+		t.Fatalf("leader rejected Start()")
+	}
+
+	// the majority elects a leader of its own, and goes on.
+	cfg.clock.Sleep(RaftElectionTimeout)
+	leader2 := cfg.checkOneLeader()
+	if leader2 == leader1 || leader2 == other {
+		t.Fatalf("leader %v is in the minority", leader2)
+	}
+	index2, term2, ok := cfg.rafts[leader2].Start(103)
+	if !ok {
+		t.Fatalf("leader rejected Start()")
+	}
+	cfg.wait(index2, len(majority), term2)
+	if n, cmd := cfg.nCommitted(index); n > 0 && cmd == 102 {
+		t.Fatalf("the minority committed 102")
+	}
+
+	// once healed, everyone agrees again.
+	cfg.heal()
+	if cfg.net.Groups() != nil {
+		t.Fatalf("still partitioned after heal()")
 	}
+	cfg.one(104, servers, true)
 
 	cfg.end()
 }
 
-func TestFailAgree2B(t *testing.T) {
+func TestOneWayFollower2B(t *testing.T) {
 	servers := 3
 	cfg := make_config(t, servers, false)
 	defer cfg.cleanup()
 
-	cfg.begin("Test (2B): agreement despite follower disconnection")
+	cfg.begin("Test (2B): follower whose replies to the leader are lost")
 
 	cfg.one(101, servers, false)
 
-	// disconnect one follower from the network.
+	// the follower gets every heartbeat, the leader never hears back.
 	leader := cfg.checkOneLeader()
-	cfg.disconnect((leader + 1) % servers)
-
-	// the leader and remaining follower should be
-	// able to agree despite the disconnected follower.
-	cfg.one(102, servers-1, false)
-	cfg.one(103, servers-1, false)
-	time.Sleep(RaftElectionTimeout)
-	cfg.one(104, servers-1, false)
-	cfg.one(105, servers-1, false)
+	follower := (leader + 1) % servers
+	cfg.net.CutOneWay(follower, leader)
 
-	// re-connect
-	cfg.connect((leader + 1) % servers)
+	// the other follower is enough to commit, and the cut one,
+	// hearing from a live leader, doesn't disrupt it.
+	for i := 0; i < 5; i++ {
+		cfg.one(102+i, servers-1, false)
+	}
+	cfg.clock.Sleep(2 * RaftElectionTimeout)
+	if leader2 := cfg.checkOneLeader(); leader2 != leader {
+		t.Fatalf("leadership moved from %v to %v", leader, leader2)
+	}
 
-	// the full set of servers should preserve
-	// previous agreements, and be able to agree
-	// on new commands.
-	cfg.one(106, servers, true)
-	time.Sleep(RaftElectionTimeout)
-	cfg.one(107, servers, true)
+	cfg.heal()
+	cfg.one(110, servers, true)
 
 	cfg.end()
 }
 
-func TestFailNoAgree2B(t *testing.T) {
-	servers := 5
-	cfg := make_config(t, servers, false)
+func TestOneWayLeader2B(t *testing.T) {
+	servers := 3
+	opts := DefaultOptions()
+	opts.CheckQuorum = true
+	cfg := make_config_options(t, servers, false, opts)
 	defer cfg.cleanup()
 
-	cfg.begin("Test (2B): no agreement if too many followers disconnect")
-
-	cfg.one(10, servers, false)
-
-	// 3 of 5 followers disconnect
-	leader := cfg.checkOneLeader()
-	cfg.disconnect((leader + 1) % servers)
-	cfg.disconnect((leader + 2) % servers)
-	cfg.disconnect((leader + 3) % servers)
-
-	index, _, ok := cfg.rafts[leader].Start(20)
-	if ok != true {
-		t.Fatalf("leader rejected Start()")
-	}
-	if index != 2 {
-		t.Fatalf("expected index 2, got %v", index)
-	}
+	cfg.begin("Test (2B): leader that hears from no one")
 
-	time.Sleep(2 * RaftElectionTimeout)
+	cfg.one(101, servers, false)
 
-	n, _ := cfg.nCommitted(index)
-	if n > 0 {
-		t.Fatalf("%v committed but no majority", n)
+	// the followers get the leader's heartbeats, but the leader hears
+	// nothing; it has to step down for the others to go on.
+	leader1 := cfg.checkOneLeader()
+	for i := 0; i < servers; i++ {
+		if i != leader1 {
+			cfg.net.CutOneWay(i, leader1)
+		}
 	}
-
-	// repair
-	cfg.connect((leader + 1) % servers)
-	cfg.connect((leader + 2) % servers)
-	cfg.connect((leader + 3) % servers)
-
-	// the disconnected majority may have chosen a leader from
-	// among their own ranks, forgetting index 2.
+	cfg.one(102, servers-1, true)
 	leader2 := cfg.checkOneLeader()
-	index2, _, ok2 := cfg.rafts[leader2].Start(30)
-	if ok2 == false {
-		t.Fatalf("leader2 rejected Start()")
+	if leader2 == leader1 {
+		t.Fatalf("leader %v kept leading without a quorum", leader1)
 	}
-	if index2 < 2 || index2 > 3 {
-		t.Fatalf("unexpected index %v", index2)
+	if _, isLeader := cfg.rafts[leader1].GetState(); isLeader {
+		t.Fatalf("leader %v didn't step down", leader1)
 	}
 
-	cfg.one(1000, servers, true)
+	cfg.heal()
+	cfg.one(103, servers, true)
 
 	cfg.end()
 }
 
-func TestConcurrentStarts2B(t *testing.T) {
-	servers := 3
-	cfg := make_config(t, servers, false)
+func TestOneWayChurn2B(t *testing.T) {
+	servers := 5
+	opts := DefaultOptions()
+	opts.CheckQuorum = true
+	cfg := make_config_options(t, servers, false, opts)
 	defer cfg.cleanup()
 
-	cfg.begin("Test (2B): concurrent Start()s")
-
-	var success bool
-loop:
-	for try := 0; try < 5; try++ {
-		if try > 0 {
-			// give solution some time to settle
-			time.Sleep(3 * time.Second)
-		}
-
-		leader := cfg.checkOneLeader()
-		_, term, ok := cfg.rafts[leader].Start(1)
-		if !ok {
-			// leader moved on really quickly
-			continue
-		}
-
-		iters := 5
-		var wg sync.WaitGroup
-		is := make(chan int, iters)
-		for ii := 0; ii < iters; ii++ {
-			wg.Add(1)
-			go func(i int) {
-				defer wg.Done()
-				i, term1, ok := cfg.rafts[leader].Start(100 + i)
-				if term1 != term {
-					return
-				}
-				if ok != true {
-					return
-				}
-				is <- i
-			}(ii)
-		}
+	cfg.begin("Test (2B): agreement despite one-way link failures")
 
-		wg.Wait()
-		close(is)
+	cfg.one(cfg.rand.Int(), servers, true)
 
-		for j := 0; j < servers; j++ {
-			if t, _ := cfg.rafts[j].GetState(); t != term {
-				// term changed -- can't expect low RPC counts
-				continue loop
-			}
+	// cut and restore random links in one direction or the other,
+	// proposing all the while. cfg checks every applied entry.
+	for iters := 0; iters < 30; iters++ {
+		for i := 0; i < servers; i++ {
+			cfg.rafts[i].Start(cfg.rand.Int())
 		}
-
-		failed := false
-		cmds := []int{}
-		for index := range is {
-			cmd := cfg.wait(index, servers, term)
-			if ix, ok := cmd.(int); ok {
-				if ix == -1 {
-					// peers have moved on to later terms
-					// so we can't expect all Start()s to
-					// have succeeded
-					failed = true
-					break
-				}
-				cmds = append(cmds, ix)
+		from, to := cfg.rand.Intn(servers), cfg.rand.Intn(servers)
+		if from != to {
+			if cfg.rand.Intn(2) == 0 {
+				cfg.net.CutOneWay(from, to)
 			} else {
-				t.Fatalf("value %v is not an int", cmd)
+				cfg.net.RestoreOneWay(from, to)
 			}
 		}
-
-		if failed {
-			// avoid leaking goroutines
-			go func() {
-				for range is {
-				}
-			}()
-			continue
-		}
-
-		for ii := 0; ii < iters; ii++ {
-			x := 100 + ii
-			ok := false
-			for j := 0; j < len(cmds); j++ {
-				if cmds[j] == x {
-					ok = true
-				}
-			}
-			if ok == false {
-				t.Fatalf("cmd %v missing in %v", x, cmds)
-			}
+		if cfg.rand.Intn(5) == 0 {
+			cfg.heal()
 		}
-
-		success = true
-		break
+		cfg.clock.Sleep(time.Duration(cfg.rand.Intn(100)) * time.Millisecond)
 	}
 
-	if !success {
-		t.Fatalf("term changed too often")
-	}
+	cfg.heal()
+	cfg.one(cfg.rand.Int(), servers, true)
 
 	cfg.end()
 }
@@ -375,7 +1789,7 @@ func TestBackup2B(t *testing.T) {
 
 	cfg.begin("Test (2B): leader backs up quickly over incorrect follower logs")
 
-	cfg.one(rand.Int(), servers, true)
+	cfg.one(cfg.rand.Int(), servers, true)
 
 	// put leader and one follower in a partition
 	leader1 := cfg.checkOneLeader()
@@ -385,10 +1799,10 @@ func TestBackup2B(t *testing.T) {
 
 	// submit lots of commands that won't commit
 	for i := 0; i < 50; i++ {
-		cfg.rafts[leader1].Start(rand.Int())
+		cfg.rafts[leader1].Start(cfg.rand.Int())
 	}
 
-	time.Sleep(RaftElectionTimeout / 2)
+	cfg.clock.Sleep(RaftElectionTimeout / 2)
 
 	cfg.disconnect((leader1 + 0) % servers)
 	cfg.disconnect((leader1 + 1) % servers)
@@ -400,7 +1814,7 @@ func TestBackup2B(t *testing.T) {
 
 	// lots of successful commands to new group.
 	for i := 0; i < 50; i++ {
-		cfg.one(rand.Int(), 3, true)
+		cfg.one(cfg.rand.Int(), 3, true)
 	}
 
 	// now another partitioned leader and one follower
@@ -413,10 +1827,10 @@ func TestBackup2B(t *testing.T) {
 
 	// lots more commands that won't commit
 	for i := 0; i < 50; i++ {
-		cfg.rafts[leader2].Start(rand.Int())
+		cfg.rafts[leader2].Start(cfg.rand.Int())
 	}
 
-	time.Sleep(RaftElectionTimeout / 2)
+	cfg.clock.Sleep(RaftElectionTimeout / 2)
 
 	// bring original leader back to life,
 	for i := 0; i < servers; i++ {
@@ -428,14 +1842,14 @@ func TestBackup2B(t *testing.T) {
 
 	// lots of successful commands to new group.
 	for i := 0; i < 50; i++ {
-		cfg.one(rand.Int(), 3, true)
+		cfg.one(cfg.rand.Int(), 3, true)
 	}
 
 	// now everyone
 	for i := 0; i < servers; i++ {
 		cfg.connect(i)
 	}
-	cfg.one(rand.Int(), servers, true)
+	cfg.one(cfg.rand.Int(), servers, true)
 
 	cfg.end()
 }
@@ -468,7 +1882,7 @@ loop:
 	for try := 0; try < 5; try++ {
 		if try > 0 {
 			// give solution some time to settle
-			time.Sleep(3 * time.Second)
+			cfg.clock.Sleep(3 * time.Second)
 		}
 
 		leader = cfg.checkOneLeader()
@@ -482,7 +1896,7 @@ loop:
 		}
 		cmds := []int{}
 		for i := 1; i < iters+2; i++ {
-			x := int(rand.Int31())
+			x := int(cfg.rand.Int31())
 			cmds = append(cmds, x)
 			index1, term1, ok := cfg.rafts[leader].Start(x)
 			if term1 != term {
@@ -536,7 +1950,7 @@ loop:
 		t.Fatalf("term changed too often")
 	}
 
-	time.Sleep(RaftElectionTimeout)
+	cfg.clock.Sleep(RaftElectionTimeout)
 
 	total3 := 0
 	for j := 0; j < servers; j++ {
@@ -625,7 +2039,7 @@ func TestPersist22C(t *testing.T) {
 		cfg.connect((leader1 + 1) % servers)
 		cfg.connect((leader1 + 2) % servers)
 
-		time.Sleep(RaftElectionTimeout)
+		cfg.clock.Sleep(RaftElectionTimeout)
 
 		cfg.start1((leader1 + 3) % servers)
 		cfg.connect((leader1 + 3) % servers)
@@ -672,6 +2086,56 @@ func TestPersist32C(t *testing.T) {
 	cfg.end()
 }
 
+//
+// check that votes and term changes only rewrite the small hard
+// state record, not the persisted log.
+//
+func TestPersistHardState2C(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2C): hard state persisted apart from the log")
+
+	for index := 1; index < 6; index++ {
+		cfg.one(randstring(1000), servers, true)
+	}
+
+	logsize := func(i int) int {
+		n := 0
+		for _, e := range cfg.saved[i].ReadLogEntries() {
+			n += len(e)
+		}
+		return n
+	}
+
+	leader1 := cfg.checkOneLeader()
+	other := (leader1 + 1) % servers
+	before := logsize(other)
+	if before < 5*1000 {
+		t.Fatalf("log region holds %v bytes, expected at least %v", before, 5*1000)
+	}
+
+	// force elections, which only touch term and vote.
+	cfg.disconnect(leader1)
+	cfg.checkOneLeader()
+	cfg.connect(leader1)
+	cfg.checkOneLeader()
+
+	hard := len(cfg.saved[other].ReadHardState())
+	if hard == 0 || hard > 100 {
+		t.Fatalf("hard state is %v bytes, expected a small record", hard)
+	}
+	if after := logsize(other); after != before {
+		t.Fatalf("log region changed from %v to %v bytes without new entries", before, after)
+	}
+	if size := cfg.saved[other].RaftStateSize(); size != hard+before {
+		t.Fatalf("RaftStateSize() is %v, expected %v", size, hard+before)
+	}
+
+	cfg.end()
+}
+
 //
 // Test the scenarios described in Figure 8 of the extended Raft paper. Each
 // iteration asks a leader, if there is one, to insert a command in the Raft
@@ -689,26 +2153,26 @@ func TestFigure82C(t *testing.T) {
 
 	cfg.begin("Test (2C): Figure 8")
 
-	cfg.one(rand.Int(), 1, true)
+	cfg.one(cfg.rand.Int(), 1, true)
 
 	nup := servers
 	for iters := 0; iters < 1000; iters++ {
 		leader := -1
 		for i := 0; i < servers; i++ {
 			if cfg.rafts[i] != nil {
-				_, _, ok := cfg.rafts[i].Start(rand.Int())
+				_, _, ok := cfg.rafts[i].Start(cfg.rand.Int())
 				if ok {
 					leader = i
 				}
 			}
 		}
 
-		if (rand.Int() % 1000) < 100 {
-			ms := rand.Int63() % (int64(RaftElectionTimeout/time.Millisecond) / 2)
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+		if (cfg.rand.Int() % 1000) < 100 {
+			ms := cfg.rand.Int63() % (int64(RaftElectionTimeout/time.Millisecond) / 2)
+			cfg.clock.Sleep(time.Duration(ms) * time.Millisecond)
 		} else {
-			ms := (rand.Int63() % 13)
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+			ms := (cfg.rand.Int63() % 13)
+			cfg.clock.Sleep(time.Duration(ms) * time.Millisecond)
 		}
 
 		if leader != -1 {
@@ -717,7 +2181,7 @@ func TestFigure82C(t *testing.T) {
 		}
 
 		if nup < 3 {
-			s := rand.Int() % servers
+			s := cfg.rand.Int() % servers
 			if cfg.rafts[s] == nil {
 				cfg.start1(s)
 				cfg.connect(s)
@@ -733,7 +2197,7 @@ func TestFigure82C(t *testing.T) {
 		}
 	}
 
-	cfg.one(rand.Int(), servers, true)
+	cfg.one(cfg.rand.Int(), servers, true)
 
 	cfg.end()
 }
@@ -774,7 +2238,7 @@ func TestFigure8Unreliable2C(t *testing.T) {
 
 	cfg.begin("Test (2C): Figure 8 (unreliable)")
 
-	cfg.one(rand.Int()%10000, 1, true)
+	cfg.one(cfg.rand.Int()%10000, 1, true)
 
 	nup := servers
 	for iters := 0; iters < 1000; iters++ {
@@ -783,27 +2247,27 @@ func TestFigure8Unreliable2C(t *testing.T) {
 		}
 		leader := -1
 		for i := 0; i < servers; i++ {
-			_, _, ok := cfg.rafts[i].Start(rand.Int() % 10000)
+			_, _, ok := cfg.rafts[i].Start(cfg.rand.Int() % 10000)
 			if ok && cfg.connected[i] {
 				leader = i
 			}
 		}
 
-		if (rand.Int() % 1000) < 100 {
-			ms := rand.Int63() % (int64(RaftElectionTimeout/time.Millisecond) / 2)
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+		if (cfg.rand.Int() % 1000) < 100 {
+			ms := cfg.rand.Int63() % (int64(RaftElectionTimeout/time.Millisecond) / 2)
+			cfg.clock.Sleep(time.Duration(ms) * time.Millisecond)
 		} else {
-			ms := (rand.Int63() % 13)
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+			ms := (cfg.rand.Int63() % 13)
+			cfg.clock.Sleep(time.Duration(ms) * time.Millisecond)
 		}
 
-		if leader != -1 && (rand.Int()%1000) < int(RaftElectionTimeout/time.Millisecond)/2 {
+		if leader != -1 && (cfg.rand.Int()%1000) < int(RaftElectionTimeout/time.Millisecond)/2 {
 			cfg.disconnect(leader)
 			nup -= 1
 		}
 
 		if nup < 3 {
-			s := rand.Int() % servers
+			s := cfg.rand.Int() % servers
 			if cfg.connected[s] == false {
 				cfg.connect(s)
 				nup += 1
@@ -817,7 +2281,7 @@ func TestFigure8Unreliable2C(t *testing.T) {
 		}
 	}
 
-	cfg.one(rand.Int()%10000, servers, true)
+	cfg.one(cfg.rand.Int()%10000, servers, true)
 
 	cfg.end()
 }
@@ -843,7 +2307,7 @@ func internalChurn(t *testing.T, unreliable bool) {
 		defer func() { ch <- ret }()
 		values := []int{}
 		for atomic.LoadInt32(&stop) == 0 {
-			x := rand.Int()
+			x := cfg.rand.Int()
 			index := -1
 			ok := false
 			for i := 0; i < servers; i++ {
@@ -874,10 +2338,10 @@ func internalChurn(t *testing.T, unreliable bool) {
 						}
 						break
 					}
-					time.Sleep(time.Duration(to) * time.Millisecond)
+					cfg.clock.Sleep(time.Duration(to) * time.Millisecond)
 				}
 			} else {
-				time.Sleep(time.Duration(79+me*17) * time.Millisecond)
+				cfg.clock.Sleep(time.Duration(79+me*17) * time.Millisecond)
 			}
 		}
 		ret = values
@@ -891,21 +2355,21 @@ func internalChurn(t *testing.T, unreliable bool) {
 	}
 
 	for iters := 0; iters < 20; iters++ {
-		if (rand.Int() % 1000) < 200 {
-			i := rand.Int() % servers
+		if (cfg.rand.Int() % 1000) < 200 {
+			i := cfg.rand.Int() % servers
 			cfg.disconnect(i)
 		}
 
-		if (rand.Int() % 1000) < 500 {
-			i := rand.Int() % servers
+		if (cfg.rand.Int() % 1000) < 500 {
+			i := cfg.rand.Int() % servers
 			if cfg.rafts[i] == nil {
 				cfg.start1(i)
 			}
 			cfg.connect(i)
 		}
 
-		if (rand.Int() % 1000) < 200 {
-			i := rand.Int() % servers
+		if (cfg.rand.Int() % 1000) < 200 {
+			i := cfg.rand.Int() % servers
 			if cfg.rafts[i] != nil {
 				cfg.crash1(i)
 			}
@@ -915,10 +2379,10 @@ func internalChurn(t *testing.T, unreliable bool) {
 		// keep up, but not so infrequent that everything has settled
 		// down from one change to the next. Pick a value smaller than
 		// the election timeout, but not hugely smaller.
-		time.Sleep((RaftElectionTimeout * 7) / 10)
+		cfg.clock.Sleep((RaftElectionTimeout * 7) / 10)
 	}
 
-	time.Sleep(RaftElectionTimeout)
+	cfg.clock.Sleep(RaftElectionTimeout)
 	cfg.setunreliable(false)
 	for i := 0; i < servers; i++ {
 		if cfg.rafts[i] == nil {
@@ -938,9 +2402,9 @@ func internalChurn(t *testing.T, unreliable bool) {
 		values = append(values, vv...)
 	}
 
-	time.Sleep(RaftElectionTimeout)
+	cfg.clock.Sleep(RaftElectionTimeout)
 
-	lastIndex := cfg.one(rand.Int(), servers, true)
+	lastIndex := cfg.one(cfg.rand.Int(), servers, true)
 
 	really := make([]int, lastIndex+1)
 	for index := 1; index <= lastIndex; index++ {
@@ -974,3 +2438,146 @@ func TestReliableChurn2C(t *testing.T) {
 func TestUnreliableChurn2C(t *testing.T) {
 	internalChurn(t, true)
 }
+
+//
+// proposal throughput with concurrent Start()s, for several cluster
+// sizes and group commit batch limits, over a reliable and an
+// unreliable network.
+//
+func BenchmarkProposalThroughput(b *testing.B) {
+	for _, unreliable := range []bool{false, true} {
+		for _, servers := range []int{3, 5, 7} {
+			for _, batch := range []int{1, 16, 256} {
+				name := fmt.Sprintf("reliable=%v/servers=%d/batch=%d", !unreliable, servers, batch)
+				b.Run(name, func(b *testing.B) {
+					opts := DefaultOptions()
+					opts.MaxBatchEntries = batch
+					benchmarkProposals(b, servers, unreliable, opts)
+				})
+			}
+		}
+	}
+}
+
+func benchmarkProposals(b *testing.B, servers int, unreliable bool, opts Options) {
+	cfg := make_config_options(b, servers, unreliable, opts)
+	defer cfg.cleanup()
+	cfg.checkOneLeader()
+
+	proposers := 32
+	var issued int64
+	var last int64
+	var leader int64 // last server that accepted a proposal
+	b.ResetTimer()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for p := 0; p < proposers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for atomic.AddInt64(&issued, 1) <= int64(b.N) {
+				// try the known leader first, then the others; back
+				// off once every server has refused.
+				for tries := 0; ; tries++ {
+					if tries > 0 && tries%servers == 0 {
+						cfg.clock.Sleep(10 * time.Millisecond)
+					}
+					i := (int(atomic.LoadInt64(&leader)) + tries) % servers
+					cfg.mu.Lock()
+					rf := cfg.rafts[i]
+					cfg.mu.Unlock()
+					if rf == nil {
+						continue
+					}
+					if index, _, ok := rf.Start(p); ok {
+						atomic.StoreInt64(&leader, int64(i))
+						for {
+							old := atomic.LoadInt64(&last)
+							if int64(index) <= old || atomic.CompareAndSwapInt64(&last, old, int64(index)) {
+								break
+							}
+						}
+						break
+					}
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	// wait until every accepted index is applied by a majority,
+	// either with our command or one from a later leader.
+	t0 := cfg.clock.Now()
+	for {
+		if n, _ := cfg.nCommitted(int(atomic.LoadInt64(&last))); n > servers/2 {
+			break
+		}
+		if cfg.clock.Since(t0) > 10*time.Second {
+			b.Fatalf("index %v not committed", atomic.LoadInt64(&last))
+		}
+		cfg.clock.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "proposals/s")
+}
+
+//
+// cost of handing committed entries to the service, one ApplyMsg
+// at a time versus in batches.
+//
+func BenchmarkApplyDelivery(b *testing.B) {
+	b.Run("per-entry", func(b *testing.B) {
+		applyCh := make(chan ApplyMsg)
+		rf := benchmarkApplyRaft(b.N, applyCh, nil)
+		b.ResetTimer()
+		go rf.applyLogEntryDaemon()
+		benchmarkCommit(rf, b.N)
+		for m := range applyCh {
+			if m.CommandIndex == b.N {
+				break
+			}
+		}
+	})
+	for _, batch := range []int{16, 256} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			applyCh := make(chan ApplyBatch)
+			rf := benchmarkApplyRaft(b.N, nil, applyCh)
+			rf.opts.MaxApplyBatch = batch
+			b.ResetTimer()
+			go rf.applyLogEntryDaemon()
+			benchmarkCommit(rf, b.N)
+			for m := range applyCh {
+				if m.Entries[len(m.Entries)-1].CommandIndex == b.N {
+					break
+				}
+			}
+		})
+	}
+}
+
+// a bare Raft holding n entries, just enough for applyLogEntryDaemon().
+func benchmarkApplyRaft(n int, applyCh chan ApplyMsg, applyBatchCh chan ApplyBatch) *Raft {
+	rf := &Raft{}
+	rf.clock = labclock.Real
+	rf.Logs = make([]LogEntry, n+1)
+	for i := 1; i <= n; i++ {
+		rf.Logs[i] = LogEntry{Term: 1, Type: EntryNormal, Data: []byte{byte(i)}}
+	}
+	rf.applyCh = applyCh
+	rf.applyBatchCh = applyBatchCh
+	rf.commitCond = sync.NewCond(&rf.mu)
+	rf.shutdownCh = make(chan struct{})
+	return rf
+}
+
+// commit entries in small steps, as a busy leader would.
+func benchmarkCommit(rf *Raft, n int) {
+	go func() {
+		for i := 1; i <= n; i += 8 {
+			rf.mu.Lock()
+			rf.commitTo(min(i+7, n))
+			rf.mu.Unlock()
+			rf.commitCond.Broadcast()
+		}
+	}()
+}
@@ -0,0 +1,52 @@
+package raft
+
+//
+// how a Raft peer reaches the others. rf.peers[i] is a Peer with a
+// typed method per RPC; each returns true if a reply arrived, with
+// the same meaning as labrpc's ClientEnd.Call(). on the receiving
+// side, a transport hands requests to the Raft methods of the same
+// name.
+//
+// every constructor takes Peers: MakeWithTransport(),
+// MakeBatchedWithTransport() and MakeTypedWithTransport(). Make()
+// and the other labrpc ones only wrap their ClientEnds with
+// LabrpcPeers().
+//
+
+import "6.824-lab/labrpc"
+
+type Peer interface {
+	RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) bool
+	AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) bool
+	Forward(args *ForwardArgs, reply *ForwardReply) bool
+	TimeoutNow(args *TimeoutNowArgs, reply *TimeoutNowReply) bool
+}
+
+// a Peer reached over labrpc.
+type labrpcPeer struct {
+	end *labrpc.ClientEnd
+}
+
+func LabrpcPeers(ends []*labrpc.ClientEnd) []Peer {
+	peers := make([]Peer, len(ends))
+	for i, end := range ends {
+		peers[i] = labrpcPeer{end}
+	}
+	return peers
+}
+
+func (p labrpcPeer) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) bool {
+	return p.end.Call("Raft.RequestVote", args, reply)
+}
+
+func (p labrpcPeer) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) bool {
+	return p.end.Call("Raft.AppendEntries", args, reply)
+}
+
+func (p labrpcPeer) Forward(args *ForwardArgs, reply *ForwardReply) bool {
+	return p.end.Call("Raft.Forward", args, reply)
+}
+
+func (p labrpcPeer) TimeoutNow(args *TimeoutNowArgs, reply *TimeoutNowReply) bool {
+	return p.end.Call("Raft.TimeoutNow", args, reply)
+}
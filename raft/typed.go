@@ -0,0 +1,114 @@
+package raft
+
+//
+// a typed front end to Raft. the service supplies a Codec for its
+// command type C; TypedRaft.Start() takes a C and the apply channel
+// carries TypedApplyMsg[C], so there is nothing to labgob.Register()
+// and no type assertions on apply.
+//
+// rf := MakeTyped[C](peers, me, persister, applyCh, codec, opts)
+//   -- or MakeTypedWithTransport[C]() over Peers, see transport.go.
+// rf.Start(cmd C) (index, term, err)
+//
+
+import (
+	"bytes"
+	"time"
+
+	"6.824-lab/labgob"
+	"6.824-lab/labrpc"
+)
+
+// turns commands into log entry payloads and back.
+type Codec[C any] interface {
+	Encode(cmd C) ([]byte, error)
+	Decode(data []byte) (C, error)
+}
+
+// a Codec that labgob-encodes C, for services that don't care.
+type GobCodec[C any] struct{}
+
+func (GobCodec[C]) Encode(cmd C) ([]byte, error) {
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	if err := e.Encode(cmd); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func (GobCodec[C]) Decode(data []byte) (C, error) {
+	var cmd C
+	d := labgob.NewDecoder(bytes.NewBuffer(data))
+	err := d.Decode(&cmd)
+	return cmd, err
+}
+
+// like ApplyMsg, with the payload decoded. CommandValid is false
+// for entries that carry no command, e.g. no-ops, or if the payload
+// did not decode.
+type TypedApplyMsg[C any] struct {
+	CommandValid bool
+	Command      C
+	CommandIndex int
+	CommandTerm  int
+	ProposeTime  time.Time
+	CommitTime   time.Time
+}
+
+type TypedRaft[C any] struct {
+	*Raft
+	codec Codec[C]
+}
+
+// like MakeTypedWithTransport(), over labrpc.
+func MakeTyped[C any](peers []*labrpc.ClientEnd, me int, persister *Persister,
+	applyCh chan TypedApplyMsg[C], codec Codec[C], opts Options) *TypedRaft[C] {
+	return MakeTypedWithTransport(LabrpcPeers(peers), me, persister, applyCh, codec, opts)
+}
+
+//
+// like MakeWithTransport(), for a service whose commands are of type
+// C. committed entries are decoded with codec and sent on applyCh.
+//
+func MakeTypedWithTransport[C any](peers []Peer, me int, persister *Persister,
+	applyCh chan TypedApplyMsg[C], codec Codec[C], opts Options) *TypedRaft[C] {
+	ch := make(chan ApplyMsg)
+	tr := &TypedRaft[C]{codec: codec}
+	tr.Raft = MakeWithTransport(peers, me, persister, ch, opts)
+	go func() {
+		for m := range ch {
+			applyCh <- tr.decode(m)
+		}
+		close(applyCh)
+	}()
+	return tr
+}
+
+// start agreement on cmd, see Raft.Start().
+func (tr *TypedRaft[C]) Start(cmd C) (int, int, error) {
+	data, err := tr.codec.Encode(cmd)
+	if err != nil {
+		return -1, 0, err
+	}
+	return tr.Propose(data)
+}
+
+func (tr *TypedRaft[C]) decode(m ApplyMsg) TypedApplyMsg[C] {
+	tm := TypedApplyMsg[C]{
+		CommandIndex: m.CommandIndex,
+		CommandTerm:  m.CommandTerm,
+		ProposeTime:  m.ProposeTime,
+		CommitTime:   m.CommitTime,
+	}
+	if m.CommandValid && m.CommandType == EntryNormal {
+		cmd, err := tr.codec.Decode(m.Data)
+		if err != nil {
+			DPrintf("[%d-%s]: failed to decode entry %d: %v\n", tr.me, tr.Raft, m.CommandIndex, err)
+		} else {
+			tm.Command = cmd
+			tm.CommandValid = true
+		}
+	}
+	return tm
+}